@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// bundleDir is the directory below the destination prefix holding the
+// bundles of -bundle-small.
+const bundleDir = ".gcs-upload-bundles"
+
+// metaBundle marks a bundle object, so that download extracts it.
+const metaBundle = "gcs-upload-bundle"
+
+const bundleIndexSuffix = ".index.jsonl"
+
+// bundleEntry is a line of the index of a bundle. Offset and Size locate the
+// content of the file within the bundle, so that it can be read with a
+// range request without fetching the whole bundle.
+type bundleEntry struct {
+	Name    string    `json:"name"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	CRC32C  uint32    `json:"crc32c"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// bundler packs small files into tar objects of about maxSize bytes, each
+// with a JSON lines index next to it, to save the per-object overhead of
+// millions of tiny files.
+type bundler struct {
+	newWriter func(name string) *storage.Writer
+	prefix    string
+	maxSize   int64
+	run       string
+
+	mu      sync.Mutex
+	seq     int
+	cur     *openBundle
+	files   int64
+	bundles int64
+	// err holds the errors of the written bundles and their callbacks.
+	err error
+}
+
+type openBundle struct {
+	name  string
+	w     *storage.Writer
+	tw    *tar.Writer
+	n     countWriter
+	index []bundleEntry
+	done  []bundleDone
+}
+
+// bundleDone is called with the attributes of the bundle holding a file
+// once it is written, or with the error failing it.
+type bundleDone func(bundle *storage.ObjectAttrs, err error) error
+
+// newBundler returns a bundler writing the objects below prefix with
+// newWriter, whose context must outlive the files added.
+func newBundler(newWriter func(name string) *storage.Writer, prefix string, maxSize int64) *bundler {
+	return &bundler{
+		newWriter: newWriter,
+		prefix:    prefix,
+		maxSize:   maxSize,
+		run:       strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// Add appends the file name with the content data to the current bundle.
+// done is called once the bundle is written or has failed, so that the file
+// is only taken as uploaded with its bundle. The errors of the bundle and of
+// the callbacks concern every file of the bundle and are returned by Close.
+func (b *bundler) Add(name string, fi fs.FileInfo, data []byte, done bundleDone) error {
+	b.mu.Lock()
+	full, err := b.add(name, fi, data, done)
+	if err != nil || !full {
+		b.mu.Unlock()
+		return err
+	}
+	ob := b.cur
+	b.cur = nil
+	attrs, err := b.flush(ob)
+	b.mu.Unlock()
+	// the callbacks run hooks, which must not hold up the other files.
+	if err := ob.finish(attrs, err); err != nil {
+		b.mu.Lock()
+		b.err = errors.Join(b.err, err)
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// add appends the file to the current bundle and reports whether it is
+// full.
+func (b *bundler) add(name string, fi fs.FileInfo, data []byte, done bundleDone) (bool, error) {
+	if b.cur == nil {
+		b.open()
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(fi.Mode().Perm()),
+		Size:     int64(len(data)),
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	if err := b.cur.tw.WriteHeader(hdr); err != nil {
+		return false, fmt.Errorf("bundle(%s): %w", b.cur.name, err)
+	}
+	offset := b.cur.n.n
+	if _, err := b.cur.tw.Write(data); err != nil {
+		return false, fmt.Errorf("bundle(%s): %w", b.cur.name, err)
+	}
+	b.cur.index = append(b.cur.index, bundleEntry{
+		Name:    name,
+		Offset:  offset,
+		Size:    int64(len(data)),
+		CRC32C:  crc32.Checksum(data, castagnoliTable),
+		ModTime: fi.ModTime(),
+	})
+	b.cur.done = append(b.cur.done, done)
+	b.files++
+	return b.cur.n.n >= b.maxSize, nil
+}
+
+func (b *bundler) open() {
+	name := path.Join(b.prefix, bundleDir, fmt.Sprintf("%s-%05d.tar", b.run, b.seq))
+	b.seq++
+	w := b.newWriter(name)
+	w.ContentType = "application/x-tar"
+	w.Metadata = map[string]string{metaBundle: "tar"}
+	ob := &openBundle{name: name, w: w}
+	ob.tw = tar.NewWriter(io.MultiWriter(w, &ob.n))
+	b.cur = ob
+}
+
+// flush completes the bundle ob, writes its index and returns the
+// attributes of the bundle.
+func (b *bundler) flush(ob *openBundle) (*storage.ObjectAttrs, error) {
+	if err := ob.tw.Close(); err != nil {
+		ob.w.Close()
+		return nil, fmt.Errorf("bundle(%s): %w", ob.name, err)
+	}
+	if err := ob.w.Close(); err != nil {
+		return nil, fmt.Errorf("bundle(%s): %w", ob.name, err)
+	}
+	w := b.newWriter(ob.name + bundleIndexSuffix)
+	w.ContentType = "application/jsonl"
+	enc := json.NewEncoder(w)
+	for i := range ob.index {
+		if err := enc.Encode(&ob.index[i]); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("bundle index(%s): %w", ob.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("bundle index(%s): %w", ob.name, err)
+	}
+	b.bundles++
+	return ob.w.Attrs(), nil
+}
+
+// finish calls the callbacks of the files of the bundle, which was written
+// with attrs or failed with err, and returns err or else theirs.
+func (ob *openBundle) finish(attrs *storage.ObjectAttrs, err error) error {
+	var errs []error
+	for _, done := range ob.done {
+		errs = append(errs, done(attrs, err))
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// Close completes the last bundle and returns the number of files and
+// bundles written.
+func (b *bundler) Close() (int64, int64, error) {
+	if b == nil {
+		return 0, 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cur != nil {
+		ob := b.cur
+		b.cur = nil
+		attrs, err := b.flush(ob)
+		b.err = errors.Join(b.err, ob.finish(attrs, err))
+	}
+	return b.files, b.bundles, b.err
+}
+
+// extractBundle writes the files of the tar stream r below dir.
+func extractBundle(r io.Reader, dir string, names nameMode) (int64, error) {
+	var n int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		rel := filepath.FromSlash(names.decode(hdr.Name))
+		if !filepath.IsLocal(rel) {
+			return n, fmt.Errorf("%s: not a local path", hdr.Name)
+		}
+		name := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return n, err
+		}
+		tf, err := os.CreateTemp(filepath.Dir(name), ".gcs-upload-*")
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(tf, tr)
+		if cerr := tf.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(tf.Name(), fs.FileMode(hdr.Mode).Perm())
+		}
+		if err == nil {
+			err = os.Chtimes(tf.Name(), hdr.ModTime, hdr.ModTime)
+		}
+		if err == nil {
+			err = os.Rename(tf.Name(), name)
+		}
+		if err != nil {
+			os.Remove(tf.Name())
+			return n, err
+		}
+		n++
+	}
+}
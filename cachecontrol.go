@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cacheControlDirectives are the Cache-Control directives taking an
+// argument, which tell "max-age=60" apart from "*.html=no-cache".
+var cacheControlDirectives = map[string]bool{
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+	"no-cache":               true,
+	"private":                true,
+}
+
+// cacheControlValue is the repeatable -cache-control flag. Every value is
+// either a Cache-Control header for all objects or glob=header for the
+// objects matching glob; the first matching glob wins over the default.
+type cacheControlValue struct {
+	def   string
+	rules globMap
+}
+
+func (c *cacheControlValue) String() string {
+	if c == nil {
+		return ""
+	}
+	var values []string
+	for _, r := range c.rules {
+		values = append(values, r.glob.pattern+"="+r.value)
+	}
+	if c.def != "" {
+		values = append(values, c.def)
+	}
+	return strings.Join(values, " ")
+}
+
+func (c *cacheControlValue) Set(s string) error {
+	pattern, value, ok := strings.Cut(s, "=")
+	if !ok || strings.ContainsAny(pattern, ", ") || cacheControlDirectives[strings.ToLower(pattern)] {
+		if c.def != "" {
+			return fmt.Errorf("parse(%s): the default Cache-Control is already %q", s, c.def)
+		}
+		c.def = s
+		return nil
+	}
+	g, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	c.rules = append(c.rules, globValue{glob: g, value: value})
+	return nil
+}
+
+func (c *cacheControlValue) lookup(p string) string {
+	if v := c.rules.lookup(p); v != "" {
+		return v
+	}
+	return c.def
+}
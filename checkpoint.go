@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRunDeadline cancels the uploads still running when the grace period
+// after -deadline or -until is over.
+var errRunDeadline = fmt.Errorf("%w: run deadline reached", context.DeadlineExceeded)
+
+// checkpoint records the sources uploaded by an incomplete run, one per
+// line, so that the next run with the same file skips them. It is removed
+// once a run has processed the whole list.
+type checkpoint struct {
+	name string
+
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+func openCheckpoint(name string) (*checkpoint, error) {
+	c := &checkpoint{name: name, done: map[string]bool{}}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open checkpoint: %w", err)
+	}
+	err = readRecords(f, func(line string) error {
+		c.done[line] = true
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read checkpoint(%s): %w", name, err)
+	}
+	c.f = f
+	return c, nil
+}
+
+// readRecords calls fn with every line of the records file f, opened for
+// appending, whatever its length. A final line without its newline was torn
+// by a crash while being written: it is ignored and terminated, so that the
+// records appended next start on a line of their own.
+func readRecords(f *os.File, fn func(line string) error) error {
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if line != "" {
+				_, err = f.WriteString("\n")
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimSuffix(line, "\n")); err != nil {
+			return err
+		}
+	}
+}
+
+// Resumed reports whether the checkpoint continues a previous run.
+func (c *checkpoint) Resumed() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done) > 0
+}
+
+// Done reports whether source was uploaded by a previous run.
+func (c *checkpoint) Done(source string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[source]
+}
+
+// Record appends source to the checkpoint.
+func (c *checkpoint) Record(source string) error {
+	if c == nil {
+		return nil
+	}
+	// a name with a newline cannot be read back and is simply uploaded again.
+	if strings.Contains(source, "\n") {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.WriteString(source + "\n"); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	c.done[source] = true
+	return nil
+}
+
+// Close closes the checkpoint, removing it if complete is true.
+func (c *checkpoint) Close(complete bool) error {
+	if c == nil {
+		return nil
+	}
+	err := c.f.Close()
+	if complete {
+		err = errors.Join(err, os.Remove(c.name))
+	}
+	if err != nil {
+		return fmt.Errorf("close checkpoint: %w", err)
+	}
+	return nil
+}
+
+// parseUntil returns the next time after now matching s, given as HH:MM in
+// local time or as an RFC 3339 time.
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	hm, err := time.Parse("15:04", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse until(%s): must be HH:MM or an RFC 3339 time", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointLongAndTornLines(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ckpt")
+	long := strings.Repeat("a/", 1024*1024) + "f"
+	if err := os.WriteFile(name, []byte("x\n"+long+"\ntor"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openCheckpoint(name)
+	if err != nil {
+		t.Fatalf("openCheckpoint: %v", err)
+	}
+	if !c.Done("x") || !c.Done(long) {
+		t.Error("Done = false for a recorded source")
+	}
+	if c.Done("tor") {
+		t.Error("Done(tor) = true for a torn line")
+	}
+	if err := c.Record("y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(false); err != nil {
+		t.Fatal(err)
+	}
+	c, err = openCheckpoint(name)
+	if err != nil {
+		t.Fatalf("openCheckpoint: %v", err)
+	}
+	defer c.Close(true)
+	if !c.Done("y") || c.Done("tory") {
+		t.Error("a record after a torn line is not read back as it was written")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type chunkRule struct {
+	// maxSize is the largest file size the rule applies to; -1 for else.
+	maxSize int64
+	chunk   uint64
+}
+
+// chunkRuleList is the -chunk-rules flag, choosing the upload chunk size by
+// the size of the file: "<=8m:0,<=1g:16m,else:64m". The first matching rule
+// wins, and a chunk size of 0 uploads the file in a single request.
+type chunkRuleList []chunkRule
+
+func (l *chunkRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+	var rules []string
+	for _, r := range *l {
+		cond := "else"
+		if r.maxSize >= 0 {
+			size := bytesValue(r.maxSize)
+			cond = "<=" + size.String()
+		}
+		chunk := bytesValue(r.chunk)
+		rules = append(rules, cond+":"+chunk.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+func (l *chunkRuleList) Set(s string) error {
+	var rules chunkRuleList
+	for _, rule := range strings.Split(s, ",") {
+		cond, chunk, ok := strings.Cut(strings.TrimSpace(rule), ":")
+		if !ok {
+			return fmt.Errorf("parse(%s): a rule must be <=size:chunk or else:chunk", rule)
+		}
+		r := chunkRule{maxSize: -1}
+		if cond != "else" {
+			size, ok := strings.CutPrefix(cond, "<=")
+			if !ok {
+				return fmt.Errorf("parse(%s): a rule must be <=size:chunk or else:chunk", rule)
+			}
+			var b bytesValue
+			if err := b.Set(size); err != nil {
+				return err
+			}
+			r.maxSize = int64(b)
+		}
+		var b bytesValue
+		if err := b.Set(chunk); err != nil {
+			return err
+		}
+		r.chunk = uint64(b)
+		rules = append(rules, r)
+	}
+	*l = rules
+	return nil
+}
+
+// chunkSize returns the chunk size of a file of size bytes, if a rule
+// matches.
+func (l chunkRuleList) chunkSize(size int64) (uint64, bool) {
+	for _, r := range l {
+		if r.maxSize < 0 || size <= r.maxSize {
+			return r.chunk, true
+		}
+	}
+	return 0, false
+}
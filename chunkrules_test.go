@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestChunkRules(t *testing.T) {
+	var l chunkRuleList
+	if err := l.Set("<=8m:0, <=1g:16m, else:64m"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		size int64
+		want uint64
+	}{
+		{0, 0},
+		{8 << 20, 0},
+		{8<<20 + 1, 16 << 20},
+		{1 << 30, 16 << 20},
+		{1<<30 + 1, 64 << 20},
+	}
+	for _, tt := range tests {
+		got, ok := l.chunkSize(tt.size)
+		if !ok || got != tt.want {
+			t.Errorf("chunkSize(%d) = %d, %v, want %d", tt.size, got, ok, tt.want)
+		}
+	}
+}
+
+func TestChunkRulesNoMatch(t *testing.T) {
+	var l chunkRuleList
+	if err := l.Set("<=1k:0"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := l.chunkSize(1025); ok {
+		t.Errorf("chunkSize(1025) = %d, true, want no match", got)
+	}
+}
+
+func TestChunkRulesInvalid(t *testing.T) {
+	for _, s := range []string{"", "8m:0", "<=8m", ">8m:0", "<=x:0", "else:x"} {
+		var l chunkRuleList
+		if err := l.Set(s); err == nil {
+			t.Errorf("Set(%q) = nil, want an error", s)
+		}
+	}
+}
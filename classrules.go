@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type classRule struct {
+	Glob      string `yaml:"glob"`
+	OlderThan string `yaml:"older_than"`
+	Class     string `yaml:"class"`
+
+	glob      *glob
+	olderThan time.Duration
+}
+
+// classRules selects a storage class by path and age. The first matching
+// rule wins; a rule with both glob and older_than requires both to match.
+type classRules []classRule
+
+func loadClassRules(name string) (classRules, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read class rules: %w", err)
+	}
+	var cfg struct {
+		Rules classRules `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse class rules(%s): %w", name, err)
+	}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Class == "" {
+			return nil, fmt.Errorf("class rule %d: class is required", i)
+		}
+		r.Class = strings.ToUpper(r.Class)
+		if r.Glob != "" {
+			g, err := compileGlob(r.Glob)
+			if err != nil {
+				return nil, fmt.Errorf("class rule %d: %w", i, err)
+			}
+			r.glob = g
+		}
+		if r.OlderThan != "" {
+			d, err := parseAge(r.OlderThan)
+			if err != nil {
+				return nil, fmt.Errorf("class rule %d: %w", i, err)
+			}
+			r.olderThan = d
+		}
+	}
+	return cfg.Rules, nil
+}
+
+func (rules classRules) class(p string, fi fs.FileInfo, now time.Time) string {
+	for _, r := range rules {
+		if r.glob != nil && !r.glob.Match(p) {
+			continue
+		}
+		if r.olderThan > 0 && (fi == nil || now.Sub(fi.ModTime()) < r.olderThan) {
+			continue
+		}
+		return r.Class
+	}
+	return ""
+}
+
+// storageClasses are the classes accepted by -storage-class.
+var storageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
+// storageClassValue is the repeatable -storage-class flag. Every value is
+// either the class of all objects or glob=class for the objects matching
+// glob; the first matching glob wins over the default.
+type storageClassValue struct {
+	def   string
+	rules globMap
+}
+
+func (c *storageClassValue) String() string {
+	if c == nil {
+		return ""
+	}
+	var values []string
+	for _, r := range c.rules {
+		values = append(values, r.glob.pattern+"="+r.value)
+	}
+	if c.def != "" {
+		values = append(values, c.def)
+	}
+	return strings.Join(values, " ")
+}
+
+func (c *storageClassValue) Set(s string) error {
+	pattern, class, ok := strings.Cut(s, "=")
+	if !ok {
+		pattern, class = "", s
+	}
+	class = strings.ToUpper(class)
+	if !storageClasses[class] {
+		return fmt.Errorf("parse(%s): unknown storage class: must be STANDARD, NEARLINE, COLDLINE or ARCHIVE", s)
+	}
+	if pattern == "" {
+		if c.def != "" {
+			return fmt.Errorf("parse(%s): the default storage class is already %s", s, c.def)
+		}
+		c.def = class
+		return nil
+	}
+	g, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	c.rules = append(c.rules, globValue{glob: g, value: class})
+	return nil
+}
+
+func (c *storageClassValue) lookup(p string) string {
+	if v := c.rules.lookup(p); v != "" {
+		return v
+	}
+	return c.def
+}
+
+// parseAge parses a duration accepting a "d" (days) suffix in addition to
+// the units of time.ParseDuration.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse age(%s): %w", s, err)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("parse age(%s): %w", s, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// clientConfig holds the options of the storage client.
+type clientConfig struct {
+	// trace records or replays the requests.
+	trace *trace
+	// quotaProject is charged for the quota of the requests instead of the
+	// project of the credentials.
+	quotaProject string
+	// credentialsFile is a service account key file used instead of the
+	// application default credentials.
+	credentialsFile string
+	// scopes are the OAuth scopes of the credentials; empty means full
+	// control of storage.
+	scopes []string
+	// impersonate is the email of a service account whose short-lived
+	// tokens, minted with the credentials above, are used instead.
+	impersonate string
+	// endpoint replaces the JSON API endpoint, e.g. for fake-gcs-server or
+	// a private endpoint.
+	endpoint string
+	// noAuth sends the requests without credentials.
+	noAuth bool
+	// grpc uses the gRPC API, with Direct Connectivity where available,
+	// instead of the JSON API. Its requests cannot be observed.
+	grpc bool
+	// the tuning of the HTTP transport; zero values keep the defaults of
+	// http.DefaultTransport.
+	maxConnsPerHost     int
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	tlsHandshakeTimeout time.Duration
+	disableHTTP2        bool
+	// userAgent is appended to the User-Agent of every request.
+	userAgent string
+	// throttled counts the responses with 429 or 503, if not nil.
+	throttled *atomic.Int64
+}
+
+// newStorageClient creates a client on top of our own base transport so that
+// the upload requests can be observed.
+func newStorageClient(ctx context.Context, cfg clientConfig) (*storage.Client, error) {
+	var authOpts []option.ClientOption
+	if cfg.auth() {
+		var err error
+		authOpts, err = cfg.authOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.grpc {
+		opts := authOpts
+		if !cfg.auth() {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+		if cfg.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(cfg.endpoint))
+		}
+		if cfg.userAgent != "" {
+			opts = append(opts, option.WithUserAgent(cfg.userAgent))
+		}
+		return storage.NewGRPCClient(ctx, opts...)
+	}
+
+	hc, err := cfg.httpClient(ctx, authOpts)
+	if err != nil {
+		return nil, err
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if cfg.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.endpoint))
+	}
+	return storage.NewClient(ctx, opts...)
+}
+
+// auth reports whether the requests carry credentials. The emulator takes
+// none, and neither does a replay.
+func (cfg *clientConfig) auth() bool {
+	return os.Getenv("STORAGE_EMULATOR_HOST") == "" && !cfg.noAuth && (cfg.trace == nil || cfg.trace.enc != nil)
+}
+
+// httpClient returns a client sending the requests through our own
+// transports, authenticated with authOpts if cfg.auth().
+func (cfg *clientConfig) httpClient(ctx context.Context, authOpts []option.ClientOption) (*http.Client, error) {
+	var rt http.RoundTripper = &retransmitTransport{base: cfg.trace.transport(cfg.baseTransport())}
+	if cfg.throttled != nil {
+		rt = &throttleTransport{base: rt, n: cfg.throttled}
+	}
+	if cfg.userAgent != "" {
+		// the client ignores option.WithUserAgent with our own HTTP client.
+		rt = &userAgentTransport{base: rt, userAgent: cfg.userAgent}
+	}
+	if cfg.auth() {
+		t, err := htransport.NewTransport(ctx, rt, authOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("transport: %w", err)
+		}
+		rt = t
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// baseTransport returns a clone of http.DefaultTransport with the tuning of
+// cfg applied.
+func (cfg *clientConfig) baseTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.maxConnsPerHost > 0 {
+		t.MaxConnsPerHost = cfg.maxConnsPerHost
+	}
+	if cfg.maxIdleConns > 0 {
+		t.MaxIdleConns = cfg.maxIdleConns
+	}
+	if cfg.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.maxIdleConnsPerHost
+	}
+	if cfg.tlsHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = cfg.tlsHandshakeTimeout
+	}
+	if cfg.disableHTTP2 {
+		// a non-nil empty map prevents the upgrade to HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// authOptions returns the options authenticating the requests.
+func (cfg *clientConfig) authOptions(ctx context.Context) ([]option.ClientOption, error) {
+	scopes := cfg.scopes
+	if len(scopes) == 0 {
+		scopes = []string{storage.ScopeFullControl, "https://www.googleapis.com/auth/cloud-platform"}
+	}
+	var base []option.ClientOption
+	if cfg.credentialsFile != "" {
+		base = append(base, option.WithCredentialsFile(cfg.credentialsFile))
+	}
+	opts := []option.ClientOption{option.WithScopes(scopes...)}
+	if cfg.impersonate != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{TargetPrincipal: cfg.impersonate, Scopes: scopes}, base...)
+		if err != nil {
+			return nil, fmt.Errorf("impersonate(%s): %w", cfg.impersonate, err)
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	} else {
+		opts = append(opts, base...)
+	}
+	if cfg.quotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(cfg.quotaProject))
+	}
+	return opts, nil
+}
+
+// userAgentTransport appends userAgent to the User-Agent of the requests.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	ua := t.userAgent
+	if v := req.Header.Get("User-Agent"); v != "" {
+		ua = v + " " + ua
+	}
+	req.Header.Set("User-Agent", ua)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// runVerify compares local files with the objects they would be uploaded as
+// and prints one line per file: match, missing or differ. Nothing is
+// modified and the command fails when any file is missing or differs.
+func runVerify(args []string) error {
+	cmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload verify [-d <dir> | -l <list>] <dest>:\n")
+		cmd.PrintDefaults()
+	}
+	n := cmd.Int("n", 24, "number of goroutines for comparing")
+	dir := cmd.String("d", "", "local directory containing the uploaded files")
+	listFilePath := cmd.String("l", "", "list-file of the uploaded files")
+	symlinks := cmd.String("symlinks", "follow", "how symbolic links in -d are handled: follow, skip or error")
+	strict := cmd.Bool("strict", false, "fail on sockets, FIFOs and devices in -d instead of skipping them")
+	maxDepth := cmd.Int("max-depth", 0, "descend at most this many directory levels into -d (0 means no limit)")
+	skipHidden := cmd.Bool("skip-hidden", false, "leave out the files and directories of -d whose names start with \".\"")
+	var includeHidden globList
+	cmd.Var(&includeHidden, "include-hidden", "compare the hidden files and directories matching this glob despite -skip-hidden (repeatable)")
+	strictList := cmd.Bool("strict-list", false, "fail on a byte order mark or CRLF line endings in the list file instead of dropping them")
+	quiet := cmd.Bool("q", false, "only print the files that are missing or differ")
+	namesFlag := cmd.String("names", "utf8", "how paths became object names: utf8 or raw")
+	normalizeFlag := cmd.String("normalize", "none", "the Unicode normalization of the object names: nfc, nfd or none")
+	stripPrefix := cmd.String("strip-prefix", "", "the -strip-prefix the files were uploaded with")
+	addPrefix := cmd.String("add-prefix", "", "the -add-prefix the files were uploaded with")
+	compress := cmd.String("compress", "", "the files were uploaded with -compress zstd[:level] as <name>.zst")
+	var gzipGlobs globList
+	cmd.Var(&gzipGlobs, "gzip", "the files matching this glob were uploaded with -gzip (repeatable)")
+	decryptionKeys := cmd.String("decryption-keys", "", "comma separated customer-supplied keys of encrypted objects: base64 encoded, or files containing them")
+	cmd.Parse(args)
+
+	if cmd.NArg() != 1 || (*dir == "") == (*listFilePath == "") {
+		cmd.Usage()
+		return fmt.Errorf("invalid args")
+	}
+	names, err := parseNameMode(*namesFlag)
+	if err != nil {
+		return err
+	}
+	normalize, err := parseNormalization(*normalizeFlag)
+	if err != nil {
+		return err
+	}
+	if *compress != "" {
+		if _, err := parseCompress(*compress); err != nil {
+			return err
+		}
+		if len(gzipGlobs) > 0 {
+			return fmt.Errorf("cannot use both -compress and -gzip")
+		}
+	}
+	keys, err := loadEncryptionKeys("", *decryptionKeys)
+	if err != nil {
+		return err
+	}
+	dest, err := url.ParseRequestURI(cmd.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse dest: %w", err)
+	}
+	if dest.Scheme != "gs" || dest.Host == "" {
+		return fmt.Errorf("dest must be gs://bucket or gs://bucket/prefix: %s", dest)
+	}
+	// the objects are named as the upload names them.
+	namer := &objectNamer{
+		prefix:    objectPrefix(dest),
+		strip:     *stripPrefix,
+		add:       *addPrefix,
+		names:     names,
+		normalize: normalize,
+	}
+	if *compress != "" {
+		namer.suffix = zstdSuffix
+	}
+
+	listPath := *listFilePath
+	if *dir != "" {
+		lf, err := writeListFile(*dir, walkOptions{
+			Symlinks:      *symlinks,
+			Strict:        *strict,
+			MaxDepth:      *maxDepth,
+			SkipHidden:    *skipHidden,
+			IncludeHidden: includeHidden,
+		})
+		if lf != "" {
+			defer os.Remove(lf)
+		}
+		if err != nil {
+			return fmt.Errorf("write list file: %w", err)
+		}
+		listPath = lf
+	}
+	listFile, err := openFile(listPath)
+	if err != nil {
+		return fmt.Errorf("open list file: %w", err)
+	}
+	defer listFile.Close()
+
+	ctx := context.Background()
+	gcs, err := newStorageClient(ctx, clientConfig{})
+	if err != nil {
+		return fmt.Errorf("storage client: %w", err)
+	}
+	bucket := gcs.Bucket(dest.Hostname())
+
+	var mu sync.Mutex
+	var matched, missing, differ atomic.Int64
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(*n)
+	s := newListReader(listFile, *strictList)
+	for s.Scan() {
+		f := s.Text()
+		eg.Go(func() error {
+			name, err := namer.name(f)
+			if err != nil {
+				return err
+			}
+			var stages []writeStage
+			if gzipGlobs.Match(filepath.ToSlash(f)) {
+				stages = append(stages, gzipStage)
+			}
+			o := bucket.Object(name).Retryer(storage.WithPolicy(storage.RetryAlways))
+			status, detail, err := compareObject(ctx, o, keys, filepath.Join(*dir, f), stages)
+			if err != nil {
+				return fmt.Errorf("compare(%s): %w", f, err)
+			}
+			switch status {
+			case "match":
+				matched.Add(1)
+				if *quiet {
+					return nil
+				}
+			case "missing":
+				missing.Add(1)
+			case "differ":
+				differ.Add(1)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Printf("%s\t%s\tgs://%s/%s%s\n", status, f, o.BucketName(), o.ObjectName(), detail)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("scan list file: %w", err)
+	}
+	log.Printf("%d match, %d missing, %d differ", matched.Load(), missing.Load(), differ.Load())
+	if missing.Load() > 0 || differ.Load() > 0 {
+		return fmt.Errorf("%d objects missing or different", missing.Load()+differ.Load())
+	}
+	return nil
+}
+
+// compareObject returns the status of the local file name against o and,
+// for a difference, a detail to be appended to the report line. The content
+// is compared as stored, after the stages, except for objects compressed by
+// -compress, which are compared by the size and CRC32C of their original
+// content.
+func compareObject(ctx context.Context, o *storage.ObjectHandle, keys *encryptionKeys, name string, stages []writeStage) (string, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	attrs, err := keys.attrs(ctx, o)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "missing", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("attrs: %w", err)
+	}
+	size, crc := strconv.FormatInt(attrs.Size, 10), fmt.Sprintf("%08x", attrs.CRC32C)
+	if attrs.Metadata[metaCompression] == "zstd" {
+		size, crc, stages = attrs.Metadata[metaOriginalSize], attrs.Metadata[metaOriginalCRC32C], nil
+	}
+	// without stages the size is known without reading the file.
+	if len(stages) == 0 && size != strconv.FormatInt(fi.Size(), 10) {
+		return "differ", fmt.Sprintf("\tsize=%s, local size=%d", size, fi.Size()), nil
+	}
+	h := crc32.New(castagnoliTable)
+	var stored countWriter
+	p := pipeline{stages: stages}
+	p.TapOutput(h)
+	p.TapOutput(&stored)
+	buf := make([]byte, 512*1024)
+	if _, err := p.Run(io.Discard, f, buf); err != nil {
+		return "", "", err
+	}
+	if size != strconv.FormatInt(stored.n, 10) {
+		return "differ", fmt.Sprintf("\tsize=%s, local size=%d", size, stored.n), nil
+	}
+	if local := fmt.Sprintf("%08x", h.Sum32()); crc != local {
+		return "differ", fmt.Sprintf("\tcrc32c=%s, local crc32c=%s", crc, local), nil
+	}
+	return "match", "", nil
+}
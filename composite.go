@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxComposeParts is the number of source objects a compose accepts.
+const maxComposeParts = 32
+
+// compositeUpload uploads f as parts concurrently to temporary objects next
+// to dst and composes them into dst, as gsutil's parallel composite uploads
+// do. The parts are deleted afterwards, also when the upload fails.
+// newWriter returns the writer of a part and open the reader of the n bytes
+// at off; the parts are composed and deleted through bucket, since the key
+// of dst applies to them. apply sets the attrs of dst.
+func compositeUpload(ctx context.Context, bucket *storage.BucketHandle, dst *storage.ObjectHandle, newWriter func(ctx context.Context, name string) *objectWriter, open func(off, n int64) io.Reader, size int64, parts int, apply func(*storage.ObjectAttrs)) (*storage.ObjectAttrs, checksum, error) {
+	parts = min(parts, maxComposeParts, int(max(size, 1)))
+	partSize := (size + int64(parts) - 1) / int64(parts)
+	base := dst.ObjectName() + ".gcs-upload-part-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+
+	srcs := make([]*storage.ObjectHandle, parts)
+	crcs := make([]uint32, parts)
+	defer func() {
+		// the parts must not outlive a canceled upload.
+		ctx := context.WithoutCancel(ctx)
+		for _, src := range srcs {
+			if src == nil {
+				continue
+			}
+			if err := src.Delete(ctx); err != nil {
+				log.Printf("delete part(gs://%s/%s): %v", src.BucketName(), src.ObjectName(), err)
+			}
+		}
+	}()
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := range parts {
+		off := int64(i) * partSize
+		n := min(partSize, size-off)
+		name := base + strconv.Itoa(i)
+		w := newWriter(egCtx, name)
+		// parts are short-lived and must not incur early deletion fees.
+		w.StorageClass = "STANDARD"
+		srcs[i] = bucket.Object(name)
+		eg.Go(func() error {
+			h := crc32.New(castagnoliTable)
+			if _, err := io.Copy(io.MultiWriter(w, h), open(off, n)); err != nil {
+				w.Close()
+				return fmt.Errorf("upload part %d: %w", i, err)
+			}
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("close part %d: %w", i, err)
+			}
+			crcs[i] = h.Sum32()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, checksum{}, err
+	}
+
+	sum := partsChecksum(crcs, partSize, size)
+	c := dst.ComposerFrom(srcs...)
+	apply(&c.ObjectAttrs)
+	// GCS rejects the compose if the parts do not add up to the file.
+	c.CRC32C = sum.CRC32C
+	c.SendCRC32C = true
+	attrs, err := c.Run(ctx)
+	if err != nil {
+		return nil, checksum{}, fmt.Errorf("compose: %w", err)
+	}
+	return attrs, sum, nil
+}
+
+// partsChecksum returns the checksum of size bytes uploaded as parts of
+// partSize bytes with the CRC32Cs crcs.
+func partsChecksum(crcs []uint32, partSize, size int64) checksum {
+	sum := checksum{Size: size, CRC32C: crcs[0]}
+	for i := 1; i < len(crcs); i++ {
+		sum.CRC32C = crc32Combine(sum.CRC32C, crcs[i], min(partSize, size-int64(i)*partSize))
+	}
+	return sum
+}
+
+// crc32Combine returns the CRC32C of the concatenation of two blocks given
+// their CRC32Cs and the length of the second one, as zlib's crc32_combine.
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(even[:], odd[:])
+	gf2MatrixSquare(odd[:], even[:])
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := range mat {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
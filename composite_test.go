@@ -0,0 +1,38 @@
+package main
+
+import (
+	"hash/crc32"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestCRC32Combine(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, 1<<16)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	for _, split := range []int{0, 1, 7, 4096, 1<<16 - 1, 1 << 16} {
+		a, b := data[:split], data[split:]
+		got := crc32Combine(crc32.Checksum(a, castagnoliTable), crc32.Checksum(b, castagnoliTable), int64(len(b)))
+		if want := crc32.Checksum(data, castagnoliTable); got != want {
+			t.Errorf("split at %d: crc32Combine = %08x, want %08x", split, got, want)
+		}
+	}
+}
+
+func TestPartsChecksum(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	const partSize = 3000
+	var crcs []uint32
+	for off := 0; off < len(data); off += partSize {
+		crcs = append(crcs, crc32.Checksum(data[off:min(off+partSize, len(data))], castagnoliTable))
+	}
+	sum := partsChecksum(crcs, partSize, int64(len(data)))
+	if want := crc32.Checksum(data, castagnoliTable); sum.CRC32C != want || sum.Size != int64(len(data)) {
+		t.Errorf("partsChecksum = %+v, want CRC32C %08x and size %d", sum, want, len(data))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// metadata keys of objects compressed by -compress. The original size and
+// CRC32C let the download verify the decompressed content.
+const (
+	metaCompression    = "gcs-upload-compression"
+	metaOriginalSize   = "gcs-upload-original-size"
+	metaOriginalCRC32C = "gcs-upload-original-crc32c"
+)
+
+// zstdSuffix is appended to the names of objects compressed with zstd.
+const zstdSuffix = ".zst"
+
+// parseCompress parses "zstd" or "zstd:<level>" with a level of 1 to 22.
+func parseCompress(s string) (zstd.EncoderLevel, error) {
+	algo, level, hasLevel := strings.Cut(s, ":")
+	if algo != "zstd" {
+		return 0, fmt.Errorf("unknown compression: %s", s)
+	}
+	if !hasLevel {
+		return zstd.SpeedDefault, nil
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < 1 || n > 22 {
+		return 0, fmt.Errorf("zstd level must be 1 to 22: %s", level)
+	}
+	return zstd.EncoderLevelFromZstd(n), nil
+}
+
+// zstdStage compresses the content with zstd at level. A single encoder
+// goroutine keeps the output reproducible.
+func zstdStage(level zstd.EncoderLevel) writeStage {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	}
+}
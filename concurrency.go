@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	autoConcurrencyStart  = 8
+	autoConcurrencyMax    = 128
+	autoConcurrencyStep   = 4
+	autoConcurrencyWindow = 5 * time.Second
+)
+
+// concurrencyValue is the -n flag: a number of goroutines, or auto.
+type concurrencyValue struct {
+	n    *int
+	auto *bool
+}
+
+func (c concurrencyValue) String() string {
+	if c.auto != nil && *c.auto {
+		return "auto"
+	}
+	if c.n == nil {
+		return ""
+	}
+	return strconv.Itoa(*c.n)
+}
+
+func (c concurrencyValue) Set(s string) error {
+	if s == "auto" {
+		*c.auto = true
+		*c.n = autoConcurrencyMax
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("parse(%s): must be a positive number or auto", s)
+	}
+	*c.auto = false
+	*c.n = n
+	return nil
+}
+
+// adaptiveConcurrency limits the number of running uploads to a limit that
+// is adjusted AIMD-style every window: it grows additively while the
+// throughput keeps improving and is halved when requests are throttled or
+// uploads fail.
+type adaptiveConcurrency struct {
+	throttled *atomic.Int64
+	uploaded  *atomic.Int64
+	verbose   bool
+
+	mu            sync.Mutex
+	limit         int
+	active        int
+	wake          chan struct{}
+	windowStart   time.Time
+	lastUploaded  int64
+	objects       int64
+	failures      int64
+	lastThrottled int64
+	prevBytes     float64
+	prevObjects   float64
+}
+
+// newAdaptiveConcurrency returns a limit observing the throttled responses
+// and the uploaded bytes counted by the callers.
+func newAdaptiveConcurrency(throttled, uploaded *atomic.Int64, verbose bool) *adaptiveConcurrency {
+	return &adaptiveConcurrency{
+		throttled:    throttled,
+		uploaded:     uploaded,
+		lastUploaded: uploaded.Load(),
+		verbose:      verbose,
+		limit:        autoConcurrencyStart,
+		wake:         make(chan struct{}),
+		windowStart:  time.Now(),
+	}
+}
+
+// Acquire waits until another upload may run.
+func (a *adaptiveConcurrency) Acquire(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	for {
+		a.mu.Lock()
+		if a.active < a.limit {
+			a.active++
+			a.mu.Unlock()
+			return nil
+		}
+		wake := a.wake
+		a.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release ends an upload.
+func (a *adaptiveConcurrency) Release(failed bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	if failed {
+		a.failures++
+	} else {
+		a.objects++
+	}
+	if now := time.Now(); now.Sub(a.windowStart) >= autoConcurrencyWindow {
+		a.adjust(now)
+	}
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+func (a *adaptiveConcurrency) adjust(now time.Time) {
+	elapsed := now.Sub(a.windowStart).Seconds()
+	uploaded := a.uploaded.Load()
+	bytes, objects := float64(uploaded-a.lastUploaded)/elapsed, float64(a.objects)/elapsed
+	throttled := a.throttled.Load()
+	prev := a.limit
+	switch {
+	case throttled > a.lastThrottled || a.failures > 0:
+		a.limit = max(1, a.limit/2)
+	case bytes > a.prevBytes*1.05 || objects > a.prevObjects*1.05:
+		a.limit = min(autoConcurrencyMax, a.limit+autoConcurrencyStep)
+	}
+	if a.verbose && a.limit != prev {
+		log.Printf("concurrency: %d -> %d (%.0f bytes/s, %.1f objects/s, %d throttled)", prev, a.limit, bytes, objects, throttled-a.lastThrottled)
+	}
+	a.prevBytes, a.prevObjects = bytes, objects
+	a.lastThrottled, a.lastUploaded = throttled, uploaded
+	a.windowStart = now
+	a.objects, a.failures = 0, 0
+}
+
+// throttleTransport counts the responses telling the client to slow down.
+type throttleTransport struct {
+	base http.RoundTripper
+	n    *atomic.Int64
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		t.n.Add(1)
+	}
+	return resp, err
+}
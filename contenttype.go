@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadContentTypeMap reads a JSON object of glob to Content-Type, keeping the
+// order of the globs.
+func loadContentTypeMap(name string) (globMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open content type map: %w", err)
+	}
+	defer f.Close()
+
+	// decoded token by token, since a Go map would lose the order of the
+	// globs.
+	dec := json.NewDecoder(f)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("parse content type map(%s): want a JSON object of glob to type", name)
+	}
+	var m globMap
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("parse content type map(%s): %w", name, err)
+		}
+		pattern := t.(string)
+		var contentType string
+		if err := dec.Decode(&contentType); err != nil {
+			return nil, fmt.Errorf("parse content type map(%s): %s: %w", name, pattern, err)
+		}
+		g, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("content type map: %w", err)
+		}
+		m = append(m, globValue{glob: g, value: contentType})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("parse content type map(%s): %w", name, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// encryptionKeys holds customer-supplied AES-256 keys. Objects are written
+// with the encryption key and read with whichever key GCS reports they were
+// encrypted with, so that reads keep working while keys are rotated.
+type encryptionKeys struct {
+	encrypt []byte
+	byHash  map[string][]byte
+}
+
+// loadEncryptionKeys parses -encryption-key and the comma separated
+// -decryption-keys. It returns nil if neither is set.
+func loadEncryptionKeys(encrypt, decrypt string) (*encryptionKeys, error) {
+	if encrypt == "" && decrypt == "" {
+		return nil, nil
+	}
+	k := &encryptionKeys{byHash: map[string][]byte{}}
+	if encrypt != "" {
+		key, err := parseEncryptionKey(encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key: %w", err)
+		}
+		k.encrypt = key
+		k.add(key)
+	}
+	for _, s := range strings.Split(decrypt, ",") {
+		if s == "" {
+			continue
+		}
+		key, err := parseEncryptionKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("decryption key: %w", err)
+		}
+		k.add(key)
+	}
+	return k, nil
+}
+
+func (k *encryptionKeys) add(key []byte) {
+	h := sha256.Sum256(key)
+	k.byHash[base64.StdEncoding.EncodeToString(h[:])] = key
+}
+
+// parseEncryptionKey parses a base64 encoded 32-byte key, or reads one from
+// the named file either base64 encoded or raw.
+func parseEncryptionKey(s string) ([]byte, error) {
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	b, err := os.ReadFile(s)
+	if err != nil {
+		return nil, fmt.Errorf("neither a base64 encoded 32-byte key nor a readable file: %w", err)
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: not a 32-byte key", s)
+	}
+	return key, nil
+}
+
+// forWrite returns o encrypted with the encryption key, if any.
+func (k *encryptionKeys) forWrite(o *storage.ObjectHandle) *storage.ObjectHandle {
+	if k == nil || k.encrypt == nil {
+		return o
+	}
+	return o.Key(k.encrypt)
+}
+
+// writeKey returns the encryption key, or nil.
+func (k *encryptionKeys) writeKey() []byte {
+	if k == nil {
+		return nil
+	}
+	return k.encrypt
+}
+
+// forRead returns o with the key it was encrypted with according to attrs.
+func (k *encryptionKeys) forRead(o *storage.ObjectHandle, attrs *storage.ObjectAttrs) (*storage.ObjectHandle, error) {
+	if attrs.CustomerKeySHA256 == "" {
+		return o, nil
+	}
+	if k != nil {
+		if key := k.byHash[attrs.CustomerKeySHA256]; key != nil {
+			return o.Key(key), nil
+		}
+	}
+	return nil, fmt.Errorf("encrypted with an unknown customer-supplied key (sha256 %s)", attrs.CustomerKeySHA256)
+}
+
+// attrs returns the attributes of o including the checksums, which GCS only
+// returns for an object encrypted with a customer-supplied key when given the
+// key.
+func (k *encryptionKeys) attrs(ctx context.Context, o *storage.ObjectHandle) (*storage.ObjectAttrs, error) {
+	attrs, err := o.Attrs(ctx)
+	if err != nil || attrs.CustomerKeySHA256 == "" {
+		return attrs, err
+	}
+	ko, err := k.forRead(o, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return ko.Attrs(ctx)
+}
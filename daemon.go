@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errSkipped is returned by an upload that was intentionally not performed.
+var errSkipped = errors.New("skipped")
+
+// errEmptyFile is returned by the upload of an empty file with -skip-empty.
+var errEmptyFile = errors.New("empty file")
+
+// fileVersions remembers the size and mtime of uploaded files so that the
+// runs of -every only upload what has changed since the previous run.
+type fileVersions struct {
+	mu sync.Mutex
+	m  map[string]fileVersion
+}
+
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func (v *fileVersions) Unchanged(name string, fi fs.FileInfo) bool {
+	if v == nil {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	prev, ok := v.m[name]
+	return ok && prev.size == fi.Size() && prev.modTime.Equal(fi.ModTime())
+}
+
+func (v *fileVersions) Record(name string, fi fs.FileInfo) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = map[string]fileVersion{}
+	}
+	v.m[name] = fileVersion{size: fi.Size(), modTime: fi.ModTime()}
+}
+
+type runStatus struct {
+	Running   bool      `json:"running"`
+	Runs      int       `json:"runs"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastEnd   time.Time `json:"last_end,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// runEvery calls once at every interval until ctx is done. Runs never
+// overlap: a run that takes longer than the interval causes the following
+// ticks to be skipped.
+func runEvery(ctx context.Context, interval time.Duration, healthAddr string, once func(context.Context) error) error {
+	var mu sync.Mutex
+	var st runStatus
+	if healthAddr != "" {
+		ln, err := net.Listen("tcp", healthAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				http.NotFound(w, r)
+				return
+			}
+			mu.Lock()
+			s := st
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if s.LastError != "" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(&s)
+		})}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		start := time.Now()
+		mu.Lock()
+		st.Running = true
+		st.LastStart = start
+		mu.Unlock()
+
+		err := once(ctx)
+
+		mu.Lock()
+		st.Running = false
+		st.Runs++
+		st.LastEnd = time.Now()
+		st.LastError = ""
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		mu.Unlock()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("run: %v", err)
+		}
+		if d := time.Since(start); d > interval {
+			log.Printf("run took %s, longer than -every %s: skipped overlapping runs", d.Round(time.Second), interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
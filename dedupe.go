@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// dedupeDB is the -dedupe-db of the objects uploaded by the hash of their
+// content, so that content uploaded before is copied server-side instead
+// of being sent again. Each upload appends a line of
+// "<key>\t<bucket>\t<generation>\t<name>" and the last line of a key wins.
+type dedupeDB struct {
+	mu sync.Mutex
+	f  *os.File
+	m  map[string]dedupeEntry
+}
+
+// dedupeEntry is an object holding the content of a key.
+type dedupeEntry struct {
+	Bucket     string
+	Name       string
+	Generation int64
+}
+
+func openDedupeDB(name string) (*dedupeDB, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open dedupe db: %w", err)
+	}
+	d := &dedupeDB{f: f, m: map[string]dedupeEntry{}}
+	line := 0
+	err = readRecords(f, func(s string) error {
+		line++
+		fields := strings.SplitN(s, "\t", 4)
+		if len(fields) != 4 {
+			return fmt.Errorf("line %d: want <key><TAB><bucket><TAB><generation><TAB><name>", line)
+		}
+		gen, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid generation: %s", line, fields[2])
+		}
+		d.m[fields[0]] = dedupeEntry{Bucket: fields[1], Name: fields[3], Generation: gen}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read dedupe db(%s): %w", name, err)
+	}
+	return d, nil
+}
+
+// Lookup returns the object uploaded with the content of key.
+func (d *dedupeDB) Lookup(key string) (dedupeEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.m[key]
+	return e, ok
+}
+
+// Record appends the object uploaded with the content of key.
+func (d *dedupeDB) Record(key string, attrs *storage.ObjectAttrs) error {
+	// a name with a newline cannot be read back and is simply not reused.
+	if strings.Contains(attrs.Name, "\n") {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := fmt.Fprintf(d.f, "%s\t%s\t%d\t%s\n", key, attrs.Bucket, attrs.Generation, attrs.Name); err != nil {
+		return fmt.Errorf("write dedupe db: %w", err)
+	}
+	d.m[key] = dedupeEntry{Bucket: attrs.Bucket, Name: attrs.Name, Generation: attrs.Generation}
+	return nil
+}
+
+func (d *dedupeDB) Close() error {
+	if err := d.f.Close(); err != nil {
+		return fmt.Errorf("close dedupe db: %w", err)
+	}
+	return nil
+}
+
+// dedupeKey returns the key of the content of the file name stored with
+// the Content-Encoding encoding: its SHA-256 in hex, followed by the
+// encoding, as the same content compressed or not is a different object.
+func dedupeKey(name, encoding string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("open upload file: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hash upload file: %w", err)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	if encoding != "" {
+		key += ":" + encoding
+	}
+	return key, nil
+}
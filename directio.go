@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// directIOAlign is the alignment O_DIRECT requires of the buffer, offset
+	// and length of every read on common file systems.
+	directIOAlign = 4096
+	// directIOBlock is the size of the reads of a directFile.
+	directIOBlock = 1024 * 1024
+)
+
+var directIOPool = sync.Pool{
+	New: func() any {
+		return alignedBuffer(directIOBlock)
+	},
+}
+
+// alignedBuffer returns a buffer of n bytes aligned to directIOAlign.
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directIOAlign)
+	skip := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) % directIOAlign); r != 0 {
+		skip = directIOAlign - r
+	}
+	return b[skip : skip+n : skip+n]
+}
+
+// directFile reads a file opened with O_DIRECT, bypassing the page cache so
+// that huge uploads do not evict the pages of other processes. Reads go
+// through aligned buffers of directIOBlock bytes and are copied from there.
+type directFile struct {
+	f   *os.File
+	pos int64
+
+	// buf holds the block at bufOff for the sequential reads.
+	buf    []byte
+	bufOff int64
+}
+
+func (d *directFile) Read(p []byte) (int, error) {
+	if d.buf == nil {
+		d.buf = directIOPool.Get().([]byte)[:0]
+	}
+	if d.pos < d.bufOff || d.pos >= d.bufOff+int64(len(d.buf)) {
+		d.bufOff = d.pos &^ (directIOAlign - 1)
+		n, err := d.f.ReadAt(d.buf[:cap(d.buf)], d.bufOff)
+		d.buf = d.buf[:n]
+		if d.pos >= d.bufOff+int64(n) {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf[d.pos-d.bufOff:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *directFile) ReadAt(p []byte, off int64) (int, error) {
+	blk := directIOPool.Get().([]byte)
+	defer directIOPool.Put(blk)
+	var read int
+	for read < len(p) {
+		start := off &^ (directIOAlign - 1)
+		skip := int(off - start)
+		n, err := d.f.ReadAt(blk[:min(len(blk), (skip+len(p)-read+directIOAlign-1)&^(directIOAlign-1))], start)
+		if n <= skip {
+			if err == nil {
+				err = io.EOF
+			}
+			return read, err
+		}
+		c := copy(p[read:], blk[skip:n])
+		read += c
+		off += int64(c)
+		if err != nil && read < len(p) {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (d *directFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		fi, err := d.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fi.Size()
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *directFile) Stat() (fs.FileInfo, error) {
+	return d.f.Stat()
+}
+
+func (d *directFile) Close() error {
+	if d.buf != nil {
+		directIOPool.Put(d.buf[:cap(d.buf)])
+		d.buf = nil
+	}
+	return d.f.Close()
+}
+
+// localFile is a source that can be read at any offset and twice cheaply.
+type localFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// asLocalFile returns r as a localFile if it is a local file.
+func asLocalFile(r sourceFile) (localFile, bool) {
+	switch f := r.(type) {
+	case *os.File:
+		return f, true
+	case *directFile:
+		return f, true
+	case *adviseFile:
+		return f, true
+	}
+	return nil, false
+}
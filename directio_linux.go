@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirect opens name with O_DIRECT. File systems without support for it,
+// such as tmpfs, do not cache the file in the first place and it is opened
+// as usual.
+func openDirect(name string) (sourceFile, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|unix.O_DIRECT, 0)
+	if errors.Is(err, unix.EINVAL) {
+		return os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &directFile{f: f}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// openDirect opens name as usual: O_DIRECT is only supported on Linux.
+func openDirect(name string) (sourceFile, error) {
+	return os.Open(name)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// runDownload downloads the objects under a gs:// URL into a local
+// directory, undoing what the upload did to them: objects stored with
+// -compress are decompressed and verified against their original checksum,
+// names encoded by -names raw are decoded, and the mtime, mode and owner
+// stored by -preserve-posix are restored.
+func runDownload(args []string) error {
+	cmd := flag.NewFlagSet("download", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload download -d <dir> <src>:\n")
+		cmd.PrintDefaults()
+	}
+	n := cmd.Int("n", 24, "number of goroutines for downloading")
+	verbose := cmd.Bool("v", false, "show verbose output")
+	dir := cmd.String("d", "", "local directory to download into")
+	namesFlag := cmd.String("names", "utf8", "how paths became object names: utf8 or raw")
+	decryptionKeys := cmd.String("decryption-keys", "", "comma separated customer-supplied keys of encrypted objects: base64 encoded, or files containing them")
+	cmd.Parse(args)
+
+	if cmd.NArg() != 1 || *dir == "" {
+		cmd.Usage()
+		return fmt.Errorf("invalid args")
+	}
+	names, err := parseNameMode(*namesFlag)
+	if err != nil {
+		return err
+	}
+	keys, err := loadEncryptionKeys("", *decryptionKeys)
+	if err != nil {
+		return err
+	}
+	src, err := url.ParseRequestURI(cmd.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse src: %w", err)
+	}
+	if src.Scheme != "gs" || src.Host == "" {
+		return fmt.Errorf("src must be gs://bucket or gs://bucket/prefix: %s", src)
+	}
+	prefix := objectPrefix(src)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	ctx := context.Background()
+	gcs, err := newStorageClient(ctx, clientConfig{})
+	if err != nil {
+		return fmt.Errorf("storage client: %w", err)
+	}
+	bucket := gcs.Bucket(src.Hostname())
+
+	// the umask is read by setting it, which must not race the downloads.
+	umask()
+	var count atomic.Int64
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(*n)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix, Projection: storage.ProjectionNoACL})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			_ = eg.Wait()
+			return fmt.Errorf("list(gs://%s/%s): %w", bucket.BucketName(), prefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+		rel := strings.TrimPrefix(attrs.Name, prefix)
+		if path.Base(path.Dir(attrs.Name)) == bundleDir {
+			if attrs.Metadata[metaBundle] != "tar" {
+				// the index is only needed to read single files.
+				continue
+			}
+			// the names in a bundle are relative to the directory holding it.
+			base := filepath.FromSlash(names.decode(strings.TrimSuffix(rel, path.Join(bundleDir, path.Base(attrs.Name)))))
+			if base != "" && !filepath.IsLocal(base) {
+				log.Printf("skip: gs://%s/%s: not a local path", attrs.Bucket, attrs.Name)
+				continue
+			}
+			eg.Go(func() error {
+				o, err := keys.forRead(bucket.Object(attrs.Name).Generation(attrs.Generation), attrs)
+				if err != nil {
+					return fmt.Errorf("download(gs://%s/%s): %w", attrs.Bucket, attrs.Name, err)
+				}
+				r, err := o.NewReader(egCtx)
+				if err != nil {
+					return fmt.Errorf("download(gs://%s/%s): %w", attrs.Bucket, attrs.Name, err)
+				}
+				defer r.Close()
+				n, err := extractBundle(r, filepath.Join(*dir, base), names)
+				if err != nil {
+					return fmt.Errorf("extract(gs://%s/%s): %w", attrs.Bucket, attrs.Name, err)
+				}
+				c := count.Add(n)
+				if *verbose {
+					log.Printf("%7d: gs://%s/%s -> %d files", c, attrs.Bucket, attrs.Name, n)
+				}
+				return nil
+			})
+			continue
+		}
+		compressed := attrs.Metadata[metaCompression] == "zstd"
+		if compressed {
+			rel = strings.TrimSuffix(rel, zstdSuffix)
+		}
+		rel = filepath.FromSlash(names.decode(rel))
+		if !filepath.IsLocal(rel) {
+			log.Printf("skip: gs://%s/%s: not a local path", attrs.Bucket, attrs.Name)
+			continue
+		}
+		eg.Go(func() error {
+			o, err := keys.forRead(bucket.Object(attrs.Name).Generation(attrs.Generation), attrs)
+			if err != nil {
+				return fmt.Errorf("download(gs://%s/%s): %w", attrs.Bucket, attrs.Name, err)
+			}
+			if err := downloadObject(egCtx, o, attrs, filepath.Join(*dir, rel)); err != nil {
+				return fmt.Errorf("download(gs://%s/%s): %w", attrs.Bucket, attrs.Name, err)
+			}
+			c := count.Add(1)
+			if *verbose {
+				log.Printf("%7d: gs://%s/%s -> %s", c, attrs.Bucket, attrs.Name, rel)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	log.Printf("downloaded: %d", count.Load())
+	return nil
+}
+
+// downloadObject writes the content of o next to name and renames it into
+// place once it is complete and verified.
+func downloadObject(ctx context.Context, o *storage.ObjectHandle, attrs *storage.ObjectAttrs, name string) error {
+	r, err := o.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Dir(name), ".gcs-upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	compressed := attrs.Metadata[metaCompression] == "zstd"
+	var content io.Reader = r
+	if compressed {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		defer d.Close()
+		content = d
+	}
+	h := crc32.New(castagnoliTable)
+	size, err := io.Copy(io.MultiWriter(tf, h), content)
+	if err != nil {
+		return err
+	}
+	if compressed && (strconv.FormatInt(size, 10) != attrs.Metadata[metaOriginalSize] || fmt.Sprintf("%08x", h.Sum32()) != attrs.Metadata[metaOriginalCRC32C]) {
+		return fmt.Errorf("%w: decompressed size=%d crc32c=%08x, want size=%s crc32c=%s", errChecksumMismatch, size, h.Sum32(), attrs.Metadata[metaOriginalSize], attrs.Metadata[metaOriginalCRC32C])
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	// temporary files are private, unlike the file created in their place,
+	// unless the recorded mode is restored.
+	if err := os.Chmod(tf.Name(), 0o666&^umask()); err != nil {
+		return err
+	}
+	if err := restorePOSIX(tf.Name(), attrs.Metadata); err != nil {
+		return fmt.Errorf("restore attributes: %w", err)
+	}
+	return os.Rename(tf.Name(), name)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "os"
+
+// fadviseDropInterval is how far the reads of an adviseFile advance before
+// the pages behind them are dropped.
+const fadviseDropInterval = 8 * 1024 * 1024
+
+// adviseFile is a local file read with readahead hints: the kernel reads
+// ahead aggressively and the pages already read are dropped from the page
+// cache, which keeps a sustained upload from spinning disks fast without
+// evicting the pages of other processes. The hints are best-effort.
+type adviseFile struct {
+	*os.File
+	pos     int64
+	dropped int64
+}
+
+// openAdvise opens name for sequential reading.
+func openAdvise(name string) (sourceFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	adviseSequential(f)
+	return &adviseFile{File: f}, nil
+}
+
+func (f *adviseFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.pos += int64(n)
+	if f.pos-f.dropped >= fadviseDropInterval {
+		adviseDontNeed(f.File, f.dropped, f.pos-f.dropped)
+		f.dropped = f.pos
+	}
+	return n, err
+}
+
+func (f *adviseFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	f.pos = pos
+	f.dropped = min(f.dropped, pos)
+	return pos, nil
+}
+
+// Close drops the pages of the whole file, including those read at an
+// offset, and closes it.
+func (f *adviseFile) Close() error {
+	adviseDontNeed(f.File, 0, 0)
+	return f.File.Close()
+}
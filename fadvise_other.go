@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// The readahead hints of -fadvise are only given on Linux.
+
+func adviseSequential(f *os.File) {}
+
+func adviseDontNeed(f *os.File, off, n int64) {}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fallbackSwitch moves the uploads to -fallback-dest once uploads to dest
+// have failed with server errors or 403s, after their retries, for after
+// files in a row, counted across the workers. Until then, every file failing
+// so is uploaded to the fallback instead of failing the run, which would
+// stop it before the switch. The uploads stay at the fallback for the rest
+// of the run.
+type fallbackSwitch struct {
+	dest  replica
+	after int64
+
+	failures atomic.Int64
+	active   atomic.Bool
+}
+
+// Active reports whether the uploads go to the fallback.
+func (s *fallbackSwitch) Active() bool {
+	return s != nil && s.active.Load()
+}
+
+// Record records the result of an upload to dest and reports whether the
+// upload is to be tried again at the fallback, which it is for every server
+// error or 403.
+func (s *fallbackSwitch) Record(err error) bool {
+	if s == nil {
+		return false
+	}
+	if err == nil {
+		s.failures.Store(0)
+		return false
+	}
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code < 500 && gerr.Code != http.StatusForbidden {
+		return false
+	}
+	if s.failures.Add(1) >= s.after && !s.active.Swap(true) {
+		log.Printf("fallback: %d uploads in a row failed, uploading to gs://%s/%s: %v", s.failures.Load(), s.dest.bucket, s.dest.prefix, err)
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestFallbackSwitch(t *testing.T) {
+	const after = 3
+	s := &fallbackSwitch{after: after}
+	unavailable := fmt.Errorf("upload: %w", &googleapi.Error{Code: http.StatusServiceUnavailable})
+
+	// the failures of concurrent workers count together, and every failed
+	// file goes to the fallback rather than failing the run.
+	var wg sync.WaitGroup
+	retried := make(chan bool, after)
+	for range after {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retried <- s.Record(unavailable)
+		}()
+	}
+	wg.Wait()
+	close(retried)
+	for r := range retried {
+		if !r {
+			t.Error("Record = false for a server error")
+		}
+	}
+	if !s.Active() {
+		t.Errorf("Active = false after %d failures in a row", after)
+	}
+}
+
+func TestFallbackSwitchInARow(t *testing.T) {
+	s := &fallbackSwitch{after: 2}
+	forbidden := &googleapi.Error{Code: http.StatusForbidden}
+	if !s.Record(forbidden) {
+		t.Error("Record = false for a 403")
+	}
+	if s.Record(nil) {
+		t.Error("Record = true for a success")
+	}
+	if !s.Record(forbidden) {
+		t.Error("Record = false for a 403")
+	}
+	if s.Active() {
+		t.Error("Active = true after failures that were not in a row")
+	}
+	if s.Record(&googleapi.Error{Code: http.StatusNotFound}) || s.Record(errors.New("local")) {
+		t.Error("Record = true for an error that is not a server error or 403")
+	}
+	if !s.Record(forbidden) || !s.Active() {
+		t.Error("not switched after 2 failures in a row")
+	}
+}
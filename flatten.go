@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// flattenNames tracks the object names of -flatten, where files of different
+// directories can end up with the same name, and resolves the collisions
+// according to policy: error, hash or overwrite. With error, the first file
+// keeps the name. With hash, every name reserved by more than one source is
+// suffixed with a hash of each, so that the names do not depend on the order
+// of the uploads; of the sources not reserved, such as those found by
+// -watch, the first keeps the name.
+type flattenNames struct {
+	policy string
+
+	mu sync.Mutex
+	m  map[string]string
+	// reserved holds the first source reserving a name, and colliding the
+	// names reserved by more than one.
+	reserved  map[string]string
+	colliding map[string]bool
+}
+
+func newFlattenNames(policy string) (*flattenNames, error) {
+	switch policy {
+	case "error", "hash", "overwrite":
+	default:
+		return nil, fmt.Errorf("-flatten-collision must be error, hash or overwrite: %s", policy)
+	}
+	return &flattenNames{policy: policy, m: map[string]string{}, reserved: map[string]string{}, colliding: map[string]bool{}}, nil
+}
+
+// Reserve records that source will claim name, before any name is claimed.
+func (f *flattenNames) Reserve(name, source string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, ok := f.reserved[name]
+	if !ok {
+		f.reserved[name] = source
+	} else if owner != source {
+		f.colliding[name] = true
+	}
+}
+
+// Claim returns the object name of source, which wants name.
+func (f *flattenNames) Claim(name, source string) (string, error) {
+	if f.policy == "overwrite" {
+		return name, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, ok := f.m[name]
+	if !f.colliding[name] && (!ok || owner == source) {
+		f.m[name] = source
+		return name, nil
+	}
+	if f.policy == "error" {
+		if !ok {
+			owner = f.reserved[name]
+		}
+		return "", fmt.Errorf("%s: -flatten collides with %s at %s", source, owner, name)
+	}
+	sum := sha256.Sum256([]byte(source))
+	ext := path.Ext(name)
+	name = strings.TrimSuffix(name, ext) + "-" + hex.EncodeToString(sum[:4]) + ext
+	f.m[name] = source
+	return name, nil
+}
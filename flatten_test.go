@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestFlattenHashOrderIndependent(t *testing.T) {
+	claim := func(sources ...string) map[string]string {
+		f, err := newFlattenNames("hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range sources {
+			f.Reserve("p/b.txt", s)
+		}
+		f.Reserve("p/c.txt", "z/c.txt")
+		names := map[string]string{}
+		for _, s := range sources {
+			name, err := f.Claim("p/b.txt", s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names[s] = name
+		}
+		return names
+	}
+	a := claim("x/b.txt", "y/b.txt")
+	b := claim("y/b.txt", "x/b.txt")
+	for s, name := range a {
+		if name == "p/b.txt" {
+			t.Errorf("%s keeps the colliding name %s", s, name)
+		}
+		if b[s] != name {
+			t.Errorf("%s is named %s or %s depending on the order", s, name, b[s])
+		}
+	}
+	if a["x/b.txt"] == a["y/b.txt"] {
+		t.Errorf("both sources are named %s", a["x/b.txt"])
+	}
+}
+
+func TestFlattenErrorFirstWins(t *testing.T) {
+	f, err := newFlattenNames("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := f.Claim("b", "x/b"); err != nil || name != "b" {
+		t.Fatalf("Claim(b, x/b) = %q, %v, want b", name, err)
+	}
+	if _, err := f.Claim("b", "y/b"); err == nil {
+		t.Error("Claim(b, y/b) = nil error, want a collision")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsSource copies objects below a gs://bucket/prefix URL with server-side
+// rewrites, so that the data never leaves Google's network.
+type gcsSource struct {
+	bucket *storage.BucketHandle
+	prefix string
+	keys   *encryptionKeys
+}
+
+// objectPrefix returns the object name prefix of a gs:// URL without
+// slashes at either end; it is "" for the bucket root, i.e. gs://bucket or
+// gs://bucket/.
+func objectPrefix(u *url.URL) string {
+	return strings.Trim(u.Path, "/")
+}
+
+func newGCSSource(bucket *storage.BucketHandle, src *url.URL, keys *encryptionKeys) *gcsSource {
+	prefix := objectPrefix(src)
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &gcsSource{bucket: bucket, prefix: prefix, keys: keys}
+}
+
+func (s *gcsSource) writeListFile(ctx context.Context) (string, error) {
+	f, err := os.CreateTemp("", "")
+	if err != nil {
+		return "", fmt.Errorf("create list file: %w", err)
+	}
+	defer f.Close()
+
+	q := &storage.Query{Prefix: s.prefix, Projection: storage.ProjectionNoACL}
+	if err := q.SetAttrSelection([]string{"Name"}); err != nil {
+		return f.Name(), fmt.Errorf("set attr selection: %w", err)
+	}
+	it := s.bucket.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return f.Name(), fmt.Errorf("list(gs://%s/%s): %w", s.bucket.BucketName(), s.prefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+		if _, err := f.WriteString(strings.TrimPrefix(attrs.Name, s.prefix) + "\n"); err != nil {
+			return f.Name(), fmt.Errorf("write path: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return f.Name(), fmt.Errorf("close list file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// copyTo rewrites the source object name into dst. The source attributes are
+// carried over explicitly so that apply can override some of them without
+// dropping the rest.
+func (s *gcsSource) copyTo(ctx context.Context, dst *storage.ObjectHandle, name string, apply func(*storage.ObjectAttrs, fs.FileInfo)) (*storage.ObjectAttrs, checksum, error) {
+	src := s.bucket.Object(s.prefix + name)
+	attrs, err := s.keys.attrs(ctx, src)
+	if err != nil {
+		return nil, checksum{}, fmt.Errorf("source attrs: %w", err)
+	}
+	if src, err = s.keys.forRead(src, attrs); err != nil {
+		return nil, checksum{}, fmt.Errorf("source: %w", err)
+	}
+	sum := checksum{Size: attrs.Size, CRC32C: attrs.CRC32C}
+	c := dst.CopierFrom(src)
+	c.ObjectAttrs = storage.ObjectAttrs{
+		ContentType:        attrs.ContentType,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		Metadata:           maps.Clone(attrs.Metadata),
+	}
+	apply(&c.ObjectAttrs, &objectInfo{name: attrs.Name, size: attrs.Size, modTime: attrs.Updated})
+	// a rewrite takes its key separately from the destination attrs.
+	c.DestinationKMSKeyName = c.ObjectAttrs.KMSKeyName
+	attrs, err = c.Run(ctx)
+	if err != nil {
+		return nil, checksum{}, fmt.Errorf("copy(gs://%s/%s): %w", src.BucketName(), src.ObjectName(), err)
+	}
+	return attrs, sum, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+var errGenerationMismatch = errors.New("object changed since the expected generation")
+
+// generations holds the generation every object is expected to have, so
+// that it is only overwritten if no one else has written it since. A source
+// without a generation expects its object not to exist.
+type generations struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+// loadGenerations reads the sources and generations of a -manifest, either
+// JSON lines or the index of a sharded one.
+func loadGenerations(name string) (*generations, error) {
+	g := &generations{m: map[string]int64{}}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read generations: %w", err)
+	}
+	var index manifestIndex
+	if json.Unmarshal(b, &index) == nil && index.Shards != nil {
+		for _, s := range index.Shards {
+			if err := g.readManifest(filepath.Join(filepath.Dir(name), s.Name)); err != nil {
+				return nil, err
+			}
+		}
+		return g, nil
+	}
+	if err := g.readManifest(name); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *generations) readManifest(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("read generations: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var e manifestEntry
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("read generations(%s): %w", name, err)
+		}
+		// a bundled file has no object of its own to overwrite.
+		if e.Member == "" {
+			g.m[e.Source] = e.Generation
+		}
+	}
+	return nil
+}
+
+// parseListGeneration splits a list file entry of the form
+// "<path>\t<generation>".
+func parseListGeneration(line string) (string, int64, error) {
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return line, 0, nil
+	}
+	gen, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("parse generation(%q): %w", line, err)
+	}
+	return line[:i], gen, nil
+}
+
+func (g *generations) Set(source string, gen int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.m[source] = gen
+}
+
+// Conditions returns the preconditions of the upload of source.
+func (g *generations) Conditions(source string) storage.Conditions {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if gen := g.m[source]; gen > 0 {
+		return storage.Conditions{GenerationMatch: gen}
+	}
+	return storage.Conditions{DoesNotExist: true}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// glob matches slash-separated paths. "*" and "?" do not cross "/" while
+// "**" matches any number of directories. A pattern without "/" is matched
+// against the base name only, like .gitignore.
+type glob struct {
+	pattern  string
+	re       *regexp.Regexp
+	baseOnly bool
+}
+
+func compileGlob(pattern string) (*glob, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" also matches zero directories.
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("glob(%s): unterminated [", pattern)
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += j
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("glob(%s): %w", pattern, err)
+	}
+	return &glob{
+		pattern:  pattern,
+		re:       re,
+		baseOnly: !strings.Contains(pattern, "/"),
+	}, nil
+}
+
+func (g *glob) Match(p string) bool {
+	if g.baseOnly {
+		if i := strings.LastIndexByte(p, '/'); i >= 0 {
+			p = p[i+1:]
+		}
+	}
+	return g.re.MatchString(p)
+}
+
+type globValue struct {
+	glob  *glob
+	value string
+}
+
+// globMap maps globs to values; the first matching glob wins.
+type globMap []globValue
+
+func (m globMap) lookup(p string) string {
+	for _, r := range m {
+		if r.glob.Match(p) {
+			return r.value
+		}
+	}
+	return ""
+}
+
+// globList is a repeatable flag of globs; it matches when any of them does.
+type globList []*glob
+
+func (l *globList) String() string {
+	if l == nil {
+		return ""
+	}
+	patterns := make([]string, 0, len(*l))
+	for _, g := range *l {
+		patterns = append(patterns, g.pattern)
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (l *globList) Set(s string) error {
+	g, err := compileGlob(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, g)
+	return nil
+}
+
+func (l globList) Match(p string) bool {
+	for _, g := range l {
+		if g.Match(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.txt", "a.txt", true},
+		{"*.txt", "dir/a.txt", true},
+		{"*.txt", "a.txt.gz", false},
+		{"dir/*.txt", "dir/a.txt", true},
+		{"dir/*.txt", "dir/sub/a.txt", false},
+		{"dir/**/*.txt", "dir/a.txt", true},
+		{"dir/**/*.txt", "dir/x/y/a.txt", true},
+		{"dir/**", "dir/x/y", true},
+		{"**/b", "b", true},
+		{"**/b", "a/b", true},
+		{"a?c", "abc", true},
+		{"a/?/c", "a///c", false},
+		{"[ab].go", "a.go", true},
+		{"[!ab].go", "a.go", false},
+		{"[!ab].go", "c.go", true},
+		{"a+b(c).txt", "a+b(c).txt", true},
+		{"a.b", "axb", false},
+	}
+	for _, tt := range tests {
+		g, err := compileGlob(tt.pattern)
+		if err != nil {
+			t.Errorf("compileGlob(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := g.Match(tt.path); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompileGlobInvalid(t *testing.T) {
+	if _, err := compileGlob("a[b"); err == nil {
+		t.Error("compileGlob(a[b) = nil error, want an error")
+	}
+}
+
+func TestGlobMapFirstMatchWins(t *testing.T) {
+	var m globMap
+	for _, r := range []struct{ pattern, value string }{{"*.html", "html"}, {"**", "any"}} {
+		g, err := compileGlob(r.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m = append(m, globValue{glob: g, value: r.value})
+	}
+	if got := m.lookup("a/index.html"); got != "html" {
+		t.Errorf("lookup(a/index.html) = %q, want html", got)
+	}
+	if got := m.lookup("a/b.css"); got != "any" {
+		t.Errorf("lookup(a/b.css) = %q, want any", got)
+	}
+}
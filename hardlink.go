@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// hardlinks tracks the local files of -dedupe-hardlinks by inode, so that
+// the content shared by hard links is uploaded once and copied server-side
+// to the objects of the other links.
+type hardlinks struct {
+	mu sync.Mutex
+	m  map[inode]*hardlinkUpload
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+// hardlinkUpload is the upload of the first link of an inode.
+type hardlinkUpload struct {
+	done  chan struct{}
+	attrs *storage.ObjectAttrs
+	sum   checksum
+}
+
+// Claim returns the upload of the inode of the file name and whether the
+// caller is the first link, which is to upload the content and Finish. It
+// returns nil for files without other links.
+func (h *hardlinks) Claim(name string) (*hardlinkUpload, bool, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, false, fmt.Errorf("stat upload file: %w", err)
+	}
+	dev, ino, nlink, ok := fileInode(fi)
+	if !ok || nlink < 2 || !fi.Mode().IsRegular() {
+		return nil, false, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.m == nil {
+		h.m = map[inode]*hardlinkUpload{}
+	}
+	k := inode{dev: dev, ino: ino}
+	if u, ok := h.m[k]; ok {
+		return u, false, nil
+	}
+	u := &hardlinkUpload{done: make(chan struct{})}
+	h.m[k] = u
+	return u, true, nil
+}
+
+// Finish records the uploaded object, or its failure as nil attrs, and
+// wakes up the other links.
+func (u *hardlinkUpload) Finish(attrs *storage.ObjectAttrs, sum checksum) {
+	u.attrs = attrs
+	u.sum = sum
+	close(u.done)
+}
+
+// Wait returns the object uploaded by the first link. It reports false when
+// that upload failed or was skipped, and the content is to be uploaded
+// again.
+func (u *hardlinkUpload) Wait(ctx context.Context) (*storage.ObjectAttrs, checksum, bool) {
+	select {
+	case <-u.done:
+	case <-ctx.Done():
+		return nil, checksum{}, false
+	}
+	return u.attrs, u.sum, u.attrs != nil
+}
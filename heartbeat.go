@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type heartbeatStatus struct {
+	State    string    `json:"state"`
+	Host     string    `json:"host"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	Uploaded int64     `json:"uploaded"`
+	Bytes    int64     `json:"bytes"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// heartbeat periodically overwrites a small status object so that long jobs
+// can be monitored without access to their logs.
+type heartbeat struct {
+	o       *storage.ObjectHandle
+	status  func() heartbeatStatus
+	started time.Time
+	host    string
+
+	stopOnce sync.Once
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func startHeartbeat(o *storage.ObjectHandle, interval time.Duration, status func() heartbeatStatus) *heartbeat {
+	host, _ := os.Hostname()
+	h := &heartbeat{
+		o:       o,
+		status:  status,
+		started: time.Now(),
+		host:    host,
+		done:    make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		h.beat("running", nil)
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-t.C:
+				h.beat("running", nil)
+			}
+		}
+	}()
+	return h
+}
+
+// Stop writes the final status of the job.
+func (h *heartbeat) Stop(err error) {
+	h.stopOnce.Do(func() {
+		close(h.done)
+		h.wg.Wait()
+		state := "done"
+		if err != nil {
+			state = "failed"
+		}
+		h.beat(state, err)
+	})
+}
+
+func (h *heartbeat) beat(state string, jobErr error) {
+	st := h.status()
+	st.State = state
+	st.Host = h.host
+	st.Started = h.started
+	st.Updated = time.Now()
+	if jobErr != nil {
+		st.Error = jobErr.Error()
+	}
+	if err := h.write(&st); err != nil {
+		log.Printf("heartbeat: %v", err)
+	}
+}
+
+func (h *heartbeat) write(st *heartbeatStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	w := h.o.NewWriter(ctx)
+	w.ContentType = "application/json"
+	w.CacheControl = "no-store"
+	// a single request is enough for such a small object.
+	w.ChunkSize = 0
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		w.Close()
+		return fmt.Errorf("encode status: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("write status: %w", err)
+	}
+	return nil
+}
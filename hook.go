@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookOutputLimit is how much of the output of a failed hook is reported.
+const hookOutputLimit = 4096
+
+// hookRunner runs the -filter-cmd and -post-hook commands so that a
+// misbehaving one cannot take the whole job down: every command gets a
+// timeout, an address space limit and a scrubbed environment, and only a
+// limited number of them run at once.
+type hookRunner struct {
+	timeout   time.Duration
+	maxMemory uint64
+	sem       chan struct{}
+	env       []string
+}
+
+// newHookRunner creates a runner passing only PATH and the variables named
+// in passEnv from our own environment.
+func newHookRunner(timeout time.Duration, maxMemory uint64, concurrency int, passEnv []string) *hookRunner {
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	for _, k := range passEnv {
+		if v, ok := os.LookupEnv(k); ok && k != "PATH" {
+			env = append(env, k+"="+v)
+		}
+	}
+	return &hookRunner{
+		timeout:   timeout,
+		maxMemory: maxMemory,
+		sem:       make(chan struct{}, max(concurrency, 1)),
+		env:       env,
+	}
+}
+
+// Run runs command with sh -c and the extra environment variables vars.
+func (h *hookRunner) Run(ctx context.Context, command string, vars ...string) error {
+	select {
+	case h.sem <- struct{}{}:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	defer func() { <-h.sem }()
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	cmd, err := h.command(ctx, command, vars...)
+	if err != nil {
+		return err
+	}
+	var out limitedBuffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start hook: %w", err)
+	}
+	err = cmd.Wait()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("hook timed out after %s: %s", h.timeout, out.String())
+	}
+	if err != nil {
+		return fmt.Errorf("hook: %w: %s", err, out.String())
+	}
+	return nil
+}
+
+// command prepares command to be run with sh -c in the scrubbed environment
+// and the extra variables vars, with the memory limit. The command gets its
+// own process group, so that the processes it spawned are killed with it
+// when ctx is done.
+func (h *hookRunner) command(ctx context.Context, command string, vars ...string) (*exec.Cmd, error) {
+	if h.maxMemory > 0 {
+		var err error
+		if command, err = limitMemory(command, h.maxMemory); err != nil {
+			return nil, fmt.Errorf("limit hook memory: %w", err)
+		}
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(append([]string{}, h.env...), vars...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = time.Second
+	return cmd, nil
+}
+
+// Filter runs command for a file and reports whether it is to be uploaded:
+// exit status 0 uploads the file, 1 skips it and anything else is an error.
+func (h *hookRunner) Filter(ctx context.Context, command string, vars ...string) (bool, error) {
+	err := h.Run(ctx, command, vars...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// limitedBuffer keeps the first hookOutputLimit bytes written to it.
+type limitedBuffer struct {
+	b bytes.Buffer
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if n := hookOutputLimit - l.b.Len(); n > 0 {
+		l.b.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (l *limitedBuffer) String() string {
+	return strings.TrimSpace(l.b.String())
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs cmd in its own process group and kills the whole
+// group on cancellation.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// limitMemory returns the shell command running command with the address
+// space limited to limit bytes. The shell limits itself before it runs
+// anything, so that the limit is in place from the first instruction of the
+// command and is inherited by everything it spawns.
+func limitMemory(command string, limit uint64) (string, error) {
+	return fmt.Sprintf("ulimit -v %d || exit 126\n%s", max(limit/1024, 1), command), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setProcessGroup leaves cmd as it is: only the process itself is killed on
+// cancellation.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func limitMemory(command string, limit uint64) (string, error) {
+	return "", errors.New("-hook-max-memory is only supported on Linux")
+}
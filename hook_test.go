@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHookMemoryLimitBeforeStart(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("-hook-max-memory is Linux only")
+	}
+	h := newHookRunner(10*time.Second, 64<<20, 1, nil)
+	if err := h.Run(context.Background(), `test "$(ulimit -v)" = 65536`); err != nil {
+		t.Errorf("the hook does not run with the limit: %v", err)
+	}
+}
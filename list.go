@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const utf8BOM = "\ufeff"
+
+// listScanner reads the entries of a list file.
+type listScanner interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// listReader reads the entries of a list file, one per line. Unlike
+// bufio.Scanner it has no limit on the length of an entry, since generated
+// paths can easily exceed 64KB. A UTF-8 BOM at the start of the list and a
+// trailing "\r" on every entry, as written by Windows tools, are dropped; in
+// strict mode they are reported as errors instead. Empty lines and lines
+// starting with "#" are skipped; a path starting with "#" can be listed as
+// "./#...".
+type listReader struct {
+	r      *bufio.Reader
+	strict bool
+	// raw takes the entries terminated by delim as they are.
+	raw   bool
+	delim byte
+	line  int
+	entry string
+	err   error
+}
+
+func newListReader(r io.Reader, strict bool) *listReader {
+	return &listReader{r: bufio.NewReader(r), strict: strict, delim: '\n'}
+}
+
+// newRawListReader returns a listReader of the entries terminated by delim
+// taken as they are, such as those of the lists written by ourselves or of
+// find -print0 with a NUL delim, which can contain newlines. Empty entries,
+// such as those of a doubled or trailing delim, name no file and are skipped.
+func newRawListReader(r io.Reader, delim byte) *listReader {
+	return &listReader{r: bufio.NewReader(r), raw: true, delim: delim}
+}
+
+func (l *listReader) Scan() bool {
+	for l.err == nil {
+		line, err := l.r.ReadString(l.delim)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				l.err = err
+				return false
+			}
+			if line == "" {
+				l.err = io.EOF
+				return false
+			}
+		}
+		l.line++
+		line = strings.TrimSuffix(line, string(l.delim))
+		if l.raw {
+			if line == "" {
+				continue
+			}
+			l.entry = line
+			return true
+		}
+		if l.line == 1 && strings.HasPrefix(line, utf8BOM) {
+			if l.strict {
+				l.err = fmt.Errorf("line 1: unexpected byte order mark")
+				return false
+			}
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
+		if strings.HasSuffix(line, "\r") {
+			if l.strict {
+				l.err = fmt.Errorf("line %d: unexpected carriage return", l.line)
+				return false
+			}
+			line = strings.TrimSuffix(line, "\r")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l.entry = line
+		return true
+	}
+	return false
+}
+
+// relativeToBase returns the list entry e relative to base. Relative entries
+// are relative to base already; absolute ones must be below it.
+func relativeToBase(base, e string) (string, error) {
+	if !filepath.IsAbs(e) {
+		return e, nil
+	}
+	rel, err := filepath.Rel(base, e)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s: not below -base %s", e, base)
+	}
+	return rel, nil
+}
+
+// objectPath returns the path the object name of the source f is derived
+// from. An absolute f is named by its path below an absolute strip, failing
+// if it is not below it, and otherwise by its path without the leading
+// slash, so that no object name starts with a slash. A relative strip is
+// then removed from the start of the path as a string, and add is put in
+// front of it. The volume of a Windows path, its drive letter, UNC share or
+// \\?\ prefix, is never part of the name.
+func objectPath(f, strip, add string) (string, error) {
+	p := filepath.ToSlash(f[len(filepath.VolumeName(f)):])
+	if filepath.IsAbs(f) {
+		if filepath.IsAbs(strip) {
+			rel, err := filepath.Rel(strip, f)
+			if err != nil || !filepath.IsLocal(rel) || rel == "." {
+				return "", fmt.Errorf("%s: not below -strip-prefix %s", f, strip)
+			}
+			return add + filepath.ToSlash(rel), nil
+		}
+		p = strings.TrimLeft(p, "/")
+	}
+	if !filepath.IsAbs(strip) {
+		p = strings.TrimLeft(strings.TrimPrefix(p, filepath.ToSlash(strip)), "/")
+	}
+	if p == "" {
+		return "", fmt.Errorf("%s: no object name is left after -strip-prefix %s", f, strip)
+	}
+	return add + p, nil
+}
+
+func (l *listReader) Text() string {
+	return l.entry
+}
+
+func (l *listReader) Err() error {
+	if errors.Is(l.err, io.EOF) {
+		return nil
+	}
+	return l.err
+}
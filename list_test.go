@@ -0,0 +1,101 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func scanList(t *testing.T, l *listReader) []string {
+	t.Helper()
+	var entries []string
+	for l.Scan() {
+		entries = append(entries, l.Text())
+	}
+	if err := l.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	return entries
+}
+
+func TestListReader(t *testing.T) {
+	long := strings.Repeat("a/", 64*1024) + "f"
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"lf", "a\nb\n", []string{"a", "b"}},
+		{"crlf", "a\r\nb\r\n", []string{"a", "b"}},
+		{"no final newline", "a\nb", []string{"a", "b"}},
+		{"crlf without final newline", "a\r\nb", []string{"a", "b"}},
+		{"longer than 64KB", "a\n" + long + "\nb\n", []string{"a", long, "b"}},
+		{"long last line", long, []string{long}},
+		{"bom", utf8BOM + "a\n", []string{"a"}},
+		{"empty lines and comments", "\n# c\na\n\n./#b\n", []string{"a", "./#b"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scanList(t, newListReader(strings.NewReader(tt.in), false))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListReaderStrict(t *testing.T) {
+	for _, in := range []string{"a\r\n", utf8BOM + "a\n", "a\nb\r"} {
+		l := newListReader(strings.NewReader(in), true)
+		for l.Scan() {
+		}
+		if l.Err() == nil {
+			t.Errorf("%q: Err() = nil, want an error", in)
+		}
+	}
+}
+
+func TestRawListReader(t *testing.T) {
+	got := scanList(t, newRawListReader(strings.NewReader("\x00a\nb\x00#c\r\x00\x00d\x00\x00"), 0))
+	want := []string{"a\nb", "#c\r", "d"}
+	if !slices.Equal(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses slash separated absolute paths")
+	}
+	tests := []struct {
+		f, strip, add string
+		want          string
+		wantErr       bool
+	}{
+		{f: "a/b", want: "a/b"},
+		{f: "/a/b", want: "a/b"},
+		{f: "/a/b", strip: "/a", want: "b"},
+		{f: "/a/b", strip: "/a/", want: "b"},
+		{f: "/x/b", strip: "/a", wantErr: true},
+		{f: "/a", strip: "/a", wantErr: true},
+		{f: "a/b/c", strip: "a/b", want: "c"},
+		{f: "/a/b/c", strip: "a/b", want: "c"},
+		{f: "a/b", strip: "a/b", wantErr: true},
+		{f: "a/b", add: "p/", want: "p/a/b"},
+		{f: "/a/b", strip: "/a", add: "p/", want: "p/b"},
+	}
+	for _, tt := range tests {
+		got, err := objectPath(tt.f, tt.strip, tt.add)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("objectPath(%q, %q, %q) = %q, want an error", tt.f, tt.strip, tt.add, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("objectPath(%q, %q, %q) = %q, %v, want %q", tt.f, tt.strip, tt.add, got, err, tt.want)
+		}
+	}
+}
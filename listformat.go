@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// listColumns are the columns of a CSV or TSV list file, in their order
+// when the file has no header.
+var listColumns = []string{"source", "object", "content_type", "metadata"}
+
+// listEntryOptions are the per-file options of an entry of a CSV or TSV list
+// file. Object is relative to the destination prefix and Metadata is a JSON
+// object.
+type listEntryOptions struct {
+	Object      string
+	ContentType string
+	Metadata    map[string]string
+}
+
+// tableListReader reads a CSV or TSV list file whose records hold the
+// source path and optionally the columns of listEntryOptions. A first record
+// starting with "source" is a header naming the columns, in any order, and
+// the columns may be left out or empty.
+type tableListReader struct {
+	r      *csv.Reader
+	cols   []string
+	record int
+	source string
+	opts   *listEntryOptions
+	err    error
+}
+
+func newTableListReader(r io.Reader, comma rune) *tableListReader {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	// TSV has no quoting, but fields in quotes are still understood.
+	cr.LazyQuotes = comma == '\t'
+	cr.ReuseRecord = true
+	return &tableListReader{r: cr, cols: listColumns}
+}
+
+func (t *tableListReader) Scan() bool {
+	if t.err != nil {
+		return false
+	}
+	rec, err := t.r.Read()
+	if err != nil {
+		t.err = err
+		return false
+	}
+	t.record++
+	if t.record == 1 && len(rec) > 0 && strings.TrimPrefix(rec[0], utf8BOM) == "source" {
+		t.cols = nil
+		for _, c := range rec {
+			c = strings.TrimPrefix(c, utf8BOM)
+			if !slices.Contains(listColumns, c) {
+				t.err = fmt.Errorf("header: unknown column %q", c)
+				return false
+			}
+			t.cols = append(t.cols, c)
+		}
+		return t.Scan()
+	}
+	if len(rec) > len(t.cols) {
+		t.err = fmt.Errorf("record %d: %d fields, want at most %d", t.record, len(rec), len(t.cols))
+		return false
+	}
+	t.source = ""
+	var opts listEntryOptions
+	for i, v := range rec {
+		switch t.cols[i] {
+		case "source":
+			t.source = v
+		case "object":
+			if v != "" {
+				if _, err := cleanObjectPath(v); err != nil {
+					t.err = fmt.Errorf("record %d: %w", t.record, err)
+					return false
+				}
+			}
+			opts.Object = v
+		case "content_type":
+			opts.ContentType = v
+		case "metadata":
+			if v == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(v), &opts.Metadata); err != nil {
+				t.err = fmt.Errorf("record %d: metadata: %w", t.record, err)
+				return false
+			}
+		}
+	}
+	t.opts = nil
+	if opts.Object != "" || opts.ContentType != "" || len(opts.Metadata) > 0 {
+		t.opts = &opts
+	}
+	return true
+}
+
+func (t *tableListReader) Text() string {
+	return t.source
+}
+
+// Options returns the options of the current entry, or nil.
+func (t *tableListReader) Options() *listEntryOptions {
+	return t.opts
+}
+
+func (t *tableListReader) Err() error {
+	if errors.Is(t.err, io.EOF) {
+		return nil
+	}
+	return t.err
+}
+
+// listOptions holds the options of the entries of a list file by source.
+type listOptions struct {
+	mu sync.Mutex
+	m  map[string]*listEntryOptions
+}
+
+func (l *listOptions) Set(source string, opts *listEntryOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = map[string]*listEntryOptions{}
+	}
+	l.m[source] = opts
+}
+
+// Get returns the options of source, or nil.
+func (l *listOptions) Get(source string) *listEntryOptions {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m[source]
+}
+
+// loadRenameMap reads the -rename-map TSV file of source paths and object
+// names. Empty lines and lines starting with "#" are skipped, as in list
+// files.
+func loadRenameMap(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open rename map: %w", err)
+	}
+	defer f.Close()
+	m := map[string]string{}
+	l := newListReader(f, false)
+	for l.Scan() {
+		source, object, ok := strings.Cut(l.Text(), "\t")
+		if !ok || source == "" {
+			return nil, fmt.Errorf("rename map(%s): line %d: want <source><TAB><object>", name, l.line)
+		}
+		if _, err := cleanObjectPath(object); err != nil {
+			return nil, fmt.Errorf("rename map(%s): line %d: %w", name, l.line, err)
+		}
+		m[filepath.Clean(source)] = object
+	}
+	if err := l.Err(); err != nil {
+		return nil, fmt.Errorf("read rename map(%s): %w", name, err)
+	}
+	return m, nil
+}
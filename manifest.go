@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type manifestEntry struct {
+	Source string `json:"source"`
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// Member is the name of the file in the bundle Name of -bundle-small.
+	Member     string            `json:"member,omitempty"`
+	Size       int64             `json:"size"`
+	Generation int64             `json:"generation"`
+	CRC32C     uint32            `json:"crc32c"`
+	MD5        []byte            `json:"md5,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// manifestIndex lists the shards of a sharded manifest in order. Shard
+// names are relative to the directory of the index.
+type manifestIndex struct {
+	Entries int64                `json:"entries"`
+	Shards  []manifestIndexShard `json:"shards"`
+}
+
+type manifestIndexShard struct {
+	Name    string `json:"name"`
+	Entries int64  `json:"entries"`
+}
+
+// manifestWriter writes one JSON object per line so that the manifest of a
+// huge run can be consumed as a stream. With a shard size the entries are
+// split into files of at most that many entries each, and the manifest
+// itself becomes an index of them.
+type manifestWriter struct {
+	name      string
+	shardSize int64
+
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	n     int64
+	index manifestIndex
+}
+
+// createManifest creates the manifest name. When resume is true, the run
+// continues one stopped with a checkpoint, whose manifest lists the objects
+// the checkpoint skips: its entries are kept and the new ones appended, as
+// further shards of a sharded manifest.
+func createManifest(name string, shardSize int64, resume bool) (*manifestWriter, error) {
+	m := &manifestWriter{name: name, shardSize: shardSize}
+	if shardSize > 0 {
+		if resume {
+			if err := m.loadShards(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(name, flag, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("create manifest: %w", err)
+	}
+	if resume {
+		if err := readRecords(f, func(string) error { return nil }); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("read manifest(%s): %w", name, err)
+		}
+	}
+	m.f = f
+	m.enc = json.NewEncoder(f)
+	return m, nil
+}
+
+// loadShards restores the index of the shards written by the stopped run,
+// from the shard files themselves if it stopped before writing the index.
+func (m *manifestWriter) loadShards() error {
+	b, err := os.ReadFile(m.name)
+	if err == nil {
+		if err := json.Unmarshal(b, &m.index); err != nil {
+			return fmt.Errorf("read manifest index(%s): %w", m.name, err)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read manifest index: %w", err)
+	}
+	for i := 0; ; i++ {
+		name := m.shardName(i)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("open manifest shard: %w", err)
+		}
+		var n int64
+		err = readRecords(f, func(string) error {
+			n++
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("read manifest shard(%s): %w", name, err)
+		}
+		m.index.Shards = append(m.index.Shards, manifestIndexShard{Name: filepath.Base(name), Entries: n})
+		m.index.Entries += n
+	}
+}
+
+// shardName returns the name of the i-th shard, e.g. manifest-00001.jsonl
+// for manifest.json.
+func (m *manifestWriter) shardName(i int) string {
+	base := strings.TrimSuffix(m.name, filepath.Ext(m.name))
+	return fmt.Sprintf("%s-%05d.jsonl", base, i)
+}
+
+func (m *manifestWriter) Write(e *manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shardSize > 0 && (m.f == nil || m.n == m.shardSize) {
+		if err := m.closeShard(); err != nil {
+			return err
+		}
+		name := m.shardName(len(m.index.Shards))
+		f, err := os.Create(name)
+		if err != nil {
+			return fmt.Errorf("create manifest shard: %w", err)
+		}
+		m.f = f
+		m.enc = json.NewEncoder(f)
+		m.n = 0
+		m.index.Shards = append(m.index.Shards, manifestIndexShard{Name: filepath.Base(name)})
+	}
+	if err := m.enc.Encode(e); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	m.n++
+	return nil
+}
+
+// closeShard closes the current shard and records its size in the index.
+func (m *manifestWriter) closeShard() error {
+	if m.f == nil {
+		return nil
+	}
+	m.index.Shards[len(m.index.Shards)-1].Entries = m.n
+	m.index.Entries += m.n
+	err := m.f.Close()
+	m.f = nil
+	if err != nil {
+		return fmt.Errorf("close manifest shard: %w", err)
+	}
+	return nil
+}
+
+func (m *manifestWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shardSize <= 0 {
+		return m.f.Close()
+	}
+	if err := m.closeShard(); err != nil {
+		return err
+	}
+	if m.index.Shards == nil {
+		m.index.Shards = []manifestIndexShard{}
+	}
+	b, err := json.MarshalIndent(&m.index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest index: %w", err)
+	}
+	// the index appears only once every shard is complete.
+	return writeFileAtomic(m.name, append(b, '\n'))
+}
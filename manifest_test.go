@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, name string, shardSize int64, resume bool, sources ...string) {
+	t.Helper()
+	m, err := createManifest(name, shardSize, resume)
+	if err != nil {
+		t.Fatalf("createManifest: %v", err)
+	}
+	for _, s := range sources {
+		if err := m.Write(&manifestEntry{Source: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestResume(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "manifest.jsonl")
+	writeManifest(t, name, 0, false, "a", "b")
+	writeManifest(t, name, 0, true, "c")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 3 {
+		t.Errorf("manifest has %d entries, want 3:\n%s", got, b)
+	}
+	writeManifest(t, name, 0, false, "d")
+	b, err = os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 1 {
+		t.Errorf("manifest of a new run has %d entries, want 1", got)
+	}
+}
+
+func TestShardedManifestResume(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "manifest.json")
+	writeManifest(t, name, 2, false, "a", "b", "c")
+	// a run that stopped before writing the index.
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	writeManifest(t, name, 2, true, "d")
+	writeManifest(t, name, 2, true, "e")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index manifestIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.Entries != 5 || len(index.Shards) != 4 {
+		t.Errorf("index = %d entries in %d shards, want 5 in 4", index.Entries, len(index.Shards))
+	}
+}
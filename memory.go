@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime/debug"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/googleapi"
+)
+
+// memoryBudget limits the memory taken by the copy buffers and the chunk
+// buffers of the writers in flight, so that a large -n or -chunk does not
+// exceed the memory limit of a container. A nil budget is unlimited.
+type memoryBudget struct {
+	max int64
+	sem *semaphore.Weighted
+}
+
+// memoryLimitHeadroom is the memory beyond the budget that the runtime is
+// allowed before the garbage collector works harder.
+const memoryLimitHeadroom = 128 * 1024 * 1024
+
+// newMemoryBudget returns a budget of max bytes. Unless GOMEMLIMIT is set, it
+// also sets the soft memory limit of the runtime, so that the buffers of
+// completed uploads are collected in time rather than by a periodic GC.
+func newMemoryBudget(max int64) *memoryBudget {
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(max + memoryLimitHeadroom)
+	}
+	return &memoryBudget{max: max, sem: semaphore.NewWeighted(max)}
+}
+
+// fileChunkSize returns the smallest chunk size holding size bytes in a
+// single chunk, a power of two times the minimal chunk size, so that small
+// files with a large -chunk take small buffers of a few sizes, which the
+// uploads pool by size.
+func fileChunkSize(size int64) int {
+	chunk := googleapi.MinUploadChunkSize
+	for int64(chunk) <= size {
+		chunk <<= 1
+	}
+	return chunk
+}
+
+// concurrency returns n reduced to the number of uploads with a copy buffer
+// of buf bytes and a chunk buffer of chunk bytes that fit in the budget.
+func (m *memoryBudget) concurrency(n, buf, chunk int) int {
+	if m == nil {
+		return n
+	}
+	return max(min(n, int(m.max/int64(buf+chunk))), 1)
+}
+
+// fit returns the chunk size of n writers reduced so that their chunk
+// buffers fit in the budget together with a copy buffer of buf bytes, and
+// the memory they take. A chunk size of 0 needs no buffer, at the cost of
+// uploading in a single request that cannot be resumed.
+func (m *memoryBudget) fit(chunk, buf, n int) (int, int64) {
+	if m == nil {
+		return chunk, 0
+	}
+	if int64(buf+n*chunk) > m.max {
+		chunk = int(m.max-int64(buf)) / n / googleapi.MinUploadChunkSize * googleapi.MinUploadChunkSize
+	}
+	return chunk, min(int64(buf+n*chunk), m.max)
+}
+
+// Acquire waits until n bytes of the budget are free and returns the func
+// releasing them.
+func (m *memoryBudget) Acquire(ctx context.Context, n int64) (func(), error) {
+	if m == nil || n == 0 {
+		return func() {}, nil
+	}
+	if err := m.sem.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	return func() { m.sem.Release(n) }, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignPublicKey is a minisign public key: an Ed25519 key and the id
+// that signatures name it by.
+type minisignPublicKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignPublicKey parses the base64 encoded key of a minisign.pub,
+// with or without its "untrusted comment:" line.
+func parseMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("decode minisign public key: %w", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, fmt.Errorf("not a minisign public key")
+	}
+	k := &minisignPublicKey{key: ed25519.PublicKey(b[10:])}
+	copy(k.id[:], b[2:10])
+	return k, nil
+}
+
+var errBadSignature = errors.New("invalid signature")
+
+// Verify checks the minisign signature sig, the content of a .minisig file,
+// of msg: the signature of the content, legacy or prehashed with BLAKE2b,
+// and the global signature covering the trusted comment.
+func (k *minisignPublicKey) Verify(msg, sig []byte) error {
+	lines := strings.Split(strings.TrimRight(string(sig), "\r\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return fmt.Errorf("%w: malformed", errBadSignature)
+	}
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(s) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed", errBadSignature)
+	}
+	if !bytes.Equal(s[2:10], k.id[:]) {
+		return fmt.Errorf("%w: signed with another key (id %X)", errBadSignature, s[2:10])
+	}
+	switch string(s[:2]) {
+	case "Ed":
+	case "ED":
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", errBadSignature, s[:2])
+	}
+	if !ed25519.Verify(k.key, msg, s[10:]) {
+		return errBadSignature
+	}
+	comment, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return fmt.Errorf("%w: no trusted comment", errBadSignature)
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed", errBadSignature)
+	}
+	if !ed25519.Verify(k.key, append(bytes.Clone(s[10:]), comment...), global) {
+		return fmt.Errorf("%w: trusted comment", errBadSignature)
+	}
+	return nil
+}
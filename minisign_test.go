@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// signMinisign returns a .minisig of msg with the algorithm alg, "Ed" or
+// the prehashed "ED", as minisign -S writes it.
+func signMinisign(priv ed25519.PrivateKey, id []byte, alg string, msg []byte, comment string) []byte {
+	if alg == "ED" {
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	}
+	sig := ed25519.Sign(priv, msg)
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+	line := append(append([]byte(alg), id...), sig...)
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(line) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestMinisignVerify(t *testing.T) {
+	pubKey, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pub, err := parseMinisignPublicKey("untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pubKey...)) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("0123abcd  gcs-upload_Linux_x86_64.tar.gz\n")
+	for _, alg := range []string{"Ed", "ED"} {
+		if err := pub.Verify(msg, signMinisign(priv, id, alg, msg, "timestamp:1700000000")); err != nil {
+			t.Errorf("%s: Verify = %v", alg, err)
+		}
+	}
+
+	sig := signMinisign(priv, id, "ED", msg, "timestamp:1700000000")
+	tampered := append([]byte("ffff"), msg[4:]...)
+	if err := pub.Verify(tampered, sig); !errors.Is(err, errBadSignature) {
+		t.Errorf("Verify of tampered content = %v, want %v", err, errBadSignature)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if err := pub.Verify(msg, signMinisign(other, id, "ED", msg, "c")); !errors.Is(err, errBadSignature) {
+		t.Errorf("Verify of a signature by another key = %v, want %v", err, errBadSignature)
+	}
+	if err := pub.Verify(msg, signMinisign(priv, []byte("otherkey"), "ED", msg, "c")); !errors.Is(err, errBadSignature) {
+		t.Errorf("Verify of a signature of another key id = %v, want %v", err, errBadSignature)
+	}
+	lines := strings.Split(string(sig), "\n")
+	lines[2] = "trusted comment: forged"
+	if err := pub.Verify(msg, []byte(strings.Join(lines, "\n"))); !errors.Is(err, errBadSignature) {
+		t.Errorf("Verify with a forged trusted comment = %v, want %v", err, errBadSignature)
+	}
+}
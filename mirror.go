@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// nameSet records the object names produced by a run.
+type nameSet struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func (s *nameSet) Add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names == nil {
+		s.names = map[string]struct{}{}
+	}
+	s.names[name] = struct{}{}
+}
+
+func (s *nameSet) Has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.names[name]
+	return ok
+}
+
+// deleteExtra deletes the objects below prefix which are not in keep, making
+// the prefix an exact mirror of the uploaded files.
+func deleteExtra(ctx context.Context, bucket *storage.BucketHandle, prefix string, keep *nameSet, n int, dryRun bool) (int64, error) {
+	if prefix != "" {
+		prefix += "/"
+	}
+	q := &storage.Query{Prefix: prefix, Projection: storage.ProjectionNoACL}
+	if err := q.SetAttrSelection([]string{"Name"}); err != nil {
+		return 0, fmt.Errorf("set attr selection: %w", err)
+	}
+
+	var deleted atomic.Int64
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(n)
+	it := bucket.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			_ = eg.Wait()
+			return deleted.Load(), fmt.Errorf("list(gs://%s/%s): %w", bucket.BucketName(), prefix, err)
+		}
+		if keep.Has(attrs.Name) {
+			continue
+		}
+		name := attrs.Name
+		if dryRun {
+			log.Printf("delete (dry-run): gs://%s/%s", bucket.BucketName(), name)
+			deleted.Add(1)
+			continue
+		}
+		eg.Go(func() error {
+			o := bucket.Object(name).Retryer(storage.WithPolicy(storage.RetryAlways))
+			if err := o.Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				return fmt.Errorf("delete(gs://%s/%s): %w", bucket.BucketName(), name, err)
+			}
+			deleted.Add(1)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return deleted.Load(), err
+	}
+	return deleted.Load(), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// The limits of an XML API multipart upload.
+const (
+	maxMultipartParts   = 10000
+	minMultipartPartLen = 5 * 1024 * 1024
+)
+
+// xmlClient sends the requests of the XML API, which the storage client
+// does not cover.
+type xmlClient struct {
+	hc          *http.Client
+	endpoint    string
+	userProject string
+	backoff     gax.Backoff
+	maxAttempts int
+}
+
+// newXMLClient returns a client for the XML API with the same transports and
+// credentials as the storage client of cfg.
+func newXMLClient(ctx context.Context, cfg clientConfig) (*xmlClient, error) {
+	var authOpts []option.ClientOption
+	if cfg.auth() {
+		var err error
+		authOpts, err = cfg.authOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hc, err := cfg.httpClient(ctx, authOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &xmlClient{hc: hc, endpoint: cfg.xmlEndpoint()}, nil
+}
+
+// xmlEndpoint returns the base URL of the XML API, which is served by the
+// host of the JSON API endpoint.
+func (cfg *clientConfig) xmlEndpoint() string {
+	if h := os.Getenv("STORAGE_EMULATOR_HOST"); h != "" {
+		if strings.Contains(h, "://") {
+			return strings.TrimSuffix(h, "/")
+		}
+		return "http://" + h
+	}
+	if u, err := url.Parse(cfg.endpoint); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return "https://storage.googleapis.com"
+}
+
+// do sends the request returned by newReq, retrying it like the storage
+// client retries idempotent requests. newReq is called for every attempt,
+// so that the body is sent from the start.
+func (c *xmlClient) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	bo := c.backoff
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.hc.Do(req.WithContext(ctx))
+		if err == nil {
+			err = googleapi.CheckResponse(resp)
+			if err == nil {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		// transport errors, 408, 429 and 5xx are retried, and errors such
+		// as those of reading the local file are not.
+		if !storage.ShouldRetry(err) || ctx.Err() != nil || (c.maxAttempts > 0 && attempt >= c.maxAttempts) {
+			return nil, err
+		}
+		if err := gax.Sleep(ctx, bo.Pause()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// objectURL returns the URL of the object with the query q, preceded by
+// the subresource sub if not empty, e.g. "uploads".
+func (c *xmlClient) objectURL(bucket, object, sub string, q url.Values) string {
+	if c.userProject != "" {
+		q.Set("userProject", c.userProject)
+	}
+	var query []string
+	if sub != "" {
+		query = append(query, sub)
+	}
+	if len(q) > 0 {
+		query = append(query, q.Encode())
+	}
+	u := c.endpoint + "/" + bucket + "/" + (&url.URL{Path: object}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + strings.Join(query, "&")
+	}
+	return u
+}
+
+// multipartParts returns the number and size of the parts of size bytes
+// uploaded as at most parts parts. Every part but the last must be at least
+// minMultipartPartLen bytes.
+func multipartParts(size int64, parts int) (int, int64) {
+	parts = max(min(parts, maxMultipartParts, int(size/minMultipartPartLen)), 1)
+	return parts, (size + int64(parts) - 1) / int64(parts)
+}
+
+// multipartUpload uploads the size bytes returned by open as parts in
+// parallel with an XML API multipart upload to bucket/object. The upload is
+// aborted when it fails. header holds the attributes and the key of the
+// object and conds its preconditions. It returns the checksum of the
+// content and the generation of the object, or 0 if the response does not
+// report it.
+func (c *xmlClient) multipartUpload(ctx context.Context, bucket, object string, header http.Header, conds storage.Conditions, open func(off, n int64) io.Reader, size int64, parts int) (checksum, int64, error) {
+	parts, partSize := multipartParts(size, parts)
+	if conds.DoesNotExist {
+		header.Set("x-goog-if-generation-match", "0")
+	} else if conds.GenerationMatch != 0 {
+		header.Set("x-goog-if-generation-match", strconv.FormatInt(conds.GenerationMatch, 10))
+	}
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.objectURL(bucket, object, "uploads", url.Values{}), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+		return req, nil
+	})
+	if err != nil {
+		return checksum{}, 0, fmt.Errorf("initiate multipart upload: %w", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return checksum{}, 0, fmt.Errorf("initiate multipart upload: %w", err)
+	}
+	uploadID := initiated.UploadID
+
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		// the uploaded parts are billed until the upload is aborted.
+		ctx := context.WithoutCancel(ctx)
+		resp, err := c.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodDelete, c.objectURL(bucket, object, "", url.Values{"uploadId": {uploadID}}), nil)
+			if err != nil {
+				return nil, err
+			}
+			copyKeyHeader(req.Header, header)
+			return req, nil
+		})
+		if err != nil {
+			log.Printf("abort multipart upload(gs://%s/%s): %v", bucket, object, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+
+	etags := make([]string, parts)
+	crcs := make([]uint32, parts)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := range parts {
+		off := int64(i) * partSize
+		n := min(partSize, size-off)
+		eg.Go(func() error {
+			h := crc32.New(castagnoliTable)
+			resp, err := c.do(egCtx, func() (*http.Request, error) {
+				h.Reset()
+				q := url.Values{"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {uploadID}}
+				req, err := http.NewRequest(http.MethodPut, c.objectURL(bucket, object, "", q), io.TeeReader(open(off, n), h))
+				if err != nil {
+					return nil, err
+				}
+				req.ContentLength = n
+				copyKeyHeader(req.Header, header)
+				return req, nil
+			})
+			if err != nil {
+				return fmt.Errorf("upload part %d: %w", i+1, err)
+			}
+			resp.Body.Close()
+			etags[i] = resp.Header.Get("ETag")
+			crcs[i] = h.Sum32()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return checksum{}, 0, err
+	}
+
+	type completePart struct {
+		PartNumber int
+		ETag       string
+	}
+	var body struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for i, etag := range etags {
+		body.Parts = append(body.Parts, completePart{PartNumber: i + 1, ETag: etag})
+	}
+	b, err := xml.Marshal(&body)
+	if err != nil {
+		return checksum{}, 0, err
+	}
+	resp, err = c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.objectURL(bucket, object, "", url.Values{"uploadId": {uploadID}}), bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		copyKeyHeader(req.Header, header)
+		if v := header.Get("x-goog-if-generation-match"); v != "" {
+			req.Header.Set("x-goog-if-generation-match", v)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return checksum{}, 0, fmt.Errorf("complete multipart upload: %w", err)
+	}
+	resp.Body.Close()
+	completed = true
+
+	gen, _ := strconv.ParseInt(resp.Header.Get("x-goog-generation"), 10, 64)
+	return partsChecksum(crcs, partSize, size), gen, nil
+}
+
+// uploadObject uploads the size bytes returned by open to o with
+// multipartUpload and returns the attributes of the new object. want holds
+// the attributes to set, key the customer-supplied key and conds the
+// preconditions of the upload, which o must not carry: the object exists
+// once the upload completes, so reading it with a precondition such as
+// DoesNotExist would fail.
+func (c *xmlClient) uploadObject(ctx context.Context, o *storage.ObjectHandle, want *storage.ObjectAttrs, key []byte, conds storage.Conditions, open func(off, n int64) io.Reader, size int64, parts int) (*storage.ObjectAttrs, checksum, error) {
+	sum, gen, err := c.multipartUpload(ctx, o.BucketName(), o.ObjectName(), xmlHeader(want, key), conds, open, size, parts)
+	if err != nil {
+		return nil, checksum{}, err
+	}
+	ro := o
+	if gen != 0 {
+		ro = o.Generation(gen)
+	}
+	attrs, err := ro.Attrs(ctx)
+	if err != nil {
+		return nil, checksum{}, err
+	}
+	// holds and retention cannot be set by the upload.
+	if want.TemporaryHold || want.EventBasedHold || want.Retention != nil {
+		attrs, err = o.If(storage.Conditions{GenerationMatch: attrs.Generation}).Update(ctx, storage.ObjectAttrsToUpdate{
+			TemporaryHold:  want.TemporaryHold,
+			EventBasedHold: want.EventBasedHold,
+			Retention:      want.Retention,
+		})
+		if err != nil {
+			return nil, checksum{}, err
+		}
+	}
+	return attrs, sum, nil
+}
+
+// copyKeyHeader copies the customer-supplied key, which every request of a
+// multipart upload must carry.
+func copyKeyHeader(dst, src http.Header) {
+	for _, k := range []string{"x-goog-encryption-algorithm", "x-goog-encryption-key", "x-goog-encryption-key-sha256"} {
+		if v := src.Get(k); v != "" {
+			dst.Set(k, v)
+		}
+	}
+}
+
+// xmlACLs maps the predefined ACLs of the JSON API to the canned ACLs of the
+// XML API.
+var xmlACLs = map[string]string{
+	"authenticatedRead":      "authenticated-read",
+	"bucketOwnerFullControl": "bucket-owner-full-control",
+	"bucketOwnerRead":        "bucket-owner-read",
+	"private":                "private",
+	"projectPrivate":         "project-private",
+	"publicRead":             "public-read",
+}
+
+// xmlHeader returns the request headers setting attrs on a new object,
+// encrypted with key if not nil. Holds and retention have no headers and
+// are set by updating the object afterwards.
+func xmlHeader(attrs *storage.ObjectAttrs, key []byte) http.Header {
+	h := http.Header{}
+	set := func(k, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("Content-Type", attrs.ContentType)
+	set("Content-Encoding", attrs.ContentEncoding)
+	set("Content-Disposition", attrs.ContentDisposition)
+	set("Content-Language", attrs.ContentLanguage)
+	set("Cache-Control", attrs.CacheControl)
+	set("x-goog-storage-class", attrs.StorageClass)
+	set("x-goog-acl", xmlACLs[attrs.PredefinedACL])
+	set("x-goog-encryption-kms-key-name", attrs.KMSKeyName)
+	if !attrs.CustomTime.IsZero() {
+		h.Set("x-goog-custom-time", attrs.CustomTime.UTC().Format(time.RFC3339Nano))
+	}
+	for k, v := range attrs.Metadata {
+		// Set would change the case of the key.
+		h["x-goog-meta-"+k] = []string{v}
+	}
+	setKeyHeader(h, key)
+	return h
+}
+
+// setKeyHeader sets the headers of the customer-supplied key, if not nil,
+// which the XML and the JSON API share.
+func setKeyHeader(h http.Header, key []byte) {
+	if key == nil {
+		return
+	}
+	sum := sha256.Sum256(key)
+	h.Set("x-goog-encryption-algorithm", "AES256")
+	h.Set("x-goog-encryption-key", base64.StdEncoding.EncodeToString(key))
+	h.Set("x-goog-encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestMultipartParts(t *testing.T) {
+	const mib = 1 << 20
+	tests := []struct {
+		size      int64
+		parts     int
+		wantParts int
+	}{
+		{0, 3, 1},
+		{4 * mib, 3, 1},
+		{12 * mib, 3, 2},
+		{15 * mib, 3, 3},
+		{100 * mib, 3, 3},
+		{1 << 40, 20000, maxMultipartParts},
+	}
+	for _, tt := range tests {
+		parts, partSize := multipartParts(tt.size, tt.parts)
+		if parts != tt.wantParts {
+			t.Errorf("multipartParts(%d, %d) = %d parts, want %d", tt.size, tt.parts, parts, tt.wantParts)
+		}
+		if parts > 1 && partSize < minMultipartPartLen {
+			t.Errorf("multipartParts(%d, %d): parts of %d bytes are smaller than %d", tt.size, tt.parts, partSize, minMultipartPartLen)
+		}
+		if int64(parts)*partSize < tt.size || int64(parts-1)*partSize >= max(tt.size, 1) {
+			t.Errorf("multipartParts(%d, %d) = %d parts of %d bytes, not covering the size exactly", tt.size, tt.parts, parts, partSize)
+		}
+	}
+}
+
+func TestUploadObjectWithPrecondition(t *testing.T) {
+	const content = "hello, multipart"
+	var gen int64
+	var completeCond string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case r.URL.Path == "/storage/v1/b/bkt/o/obj":
+			if v := q.Get("ifGenerationMatch"); v != "" && v != strconv.FormatInt(gen, 10) {
+				http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+				return
+			}
+			fmt.Fprintf(w, `{"bucket":"bkt","name":"obj","generation":"%d","metageneration":"1","size":"%d"}`, gen, len(content))
+		case r.URL.Path != "/bkt/obj":
+			http.NotFound(w, r)
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("ETag", `"e"`+q.Get("partNumber"))
+		case r.Method == http.MethodPost && q.Get("uploadId") == "u1":
+			completeCond = r.Header.Get("x-goog-if-generation-match")
+			if completeCond != "0" || gen != 0 {
+				http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+				return
+			}
+			gen = 42
+			w.Header().Set("x-goog-generation", "42")
+			fmt.Fprint(w, `<CompleteMultipartUploadResult/>`)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	gcs, err := storage.NewClient(ctx, option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication(), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcs.Close()
+	c := &xmlClient{hc: srv.Client(), endpoint: srv.URL, maxAttempts: 1}
+	open := func(off, n int64) io.Reader {
+		return io.NewSectionReader(strings.NewReader(content), off, n)
+	}
+	attrs, _, err := c.uploadObject(ctx, gcs.Bucket("bkt").Object("obj"), &storage.ObjectAttrs{}, nil, storage.Conditions{DoesNotExist: true}, open, int64(len(content)), 2)
+	if err != nil {
+		t.Fatalf("uploadObject: %v", err)
+	}
+	if completeCond != "0" {
+		t.Errorf("complete request x-goog-if-generation-match = %q, want 0", completeCond)
+	}
+	if attrs.Generation != 42 || attrs.Size != int64(len(content)) {
+		t.Errorf("attrs = generation %d, size %d, want generation 42, size %d", attrs.Generation, attrs.Size, len(content))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// nameMode selects how local path bytes become object names. GCS requires
+// object names to be valid UTF-8.
+//
+//   - utf8: paths are used as they are and invalid ones are rejected.
+//   - raw: bytes that are not valid UTF-8 and "%" are percent-encoded, so
+//     that names like Latin-1 ones survive the round trip.
+type nameMode string
+
+func parseNameMode(s string) (nameMode, error) {
+	switch nameMode(s) {
+	case "utf8", "raw":
+		return nameMode(s), nil
+	}
+	return "", fmt.Errorf("unknown name mode: %s", s)
+}
+
+// normalization is the Unicode normalization form of object names: nfc,
+// nfd or none. macOS file systems return decomposed (NFD) names, which do
+// not compare equal to the composed (NFC) ones written elsewhere.
+type normalization string
+
+func parseNormalization(s string) (normalization, error) {
+	switch normalization(s) {
+	case "nfc", "nfd", "none":
+		return normalization(s), nil
+	}
+	return "", fmt.Errorf("unknown normalization: %s", s)
+}
+
+// apply returns the object name s normalized.
+func (n normalization) apply(s string) string {
+	switch n {
+	case "nfc":
+		return norm.NFC.String(s)
+	case "nfd":
+		return norm.NFD.String(s)
+	}
+	return s
+}
+
+// maxObjectName is the length of the longest object name in bytes.
+const maxObjectName = 1024
+
+// checkObjectName reports the object names GCS rejects before they are
+// sent.
+func checkObjectName(name string) error {
+	switch {
+	case len(name) > maxObjectName:
+		return fmt.Errorf("object name is longer than %d bytes: %s", maxObjectName, name)
+	case strings.ContainsAny(name, "\r\n"):
+		return fmt.Errorf("object name contains a carriage return or line feed: %q", name)
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid object name: %s", name)
+	}
+	return nil
+}
+
+// cleanObjectPath returns the object path p relative to the prefix cleaned,
+// failing if it names no object below the prefix, e.g. "../a".
+func cleanObjectPath(p string) (string, error) {
+	name := strings.TrimLeft(path.Clean(p), "/")
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid object name %q", p)
+	}
+	return name, nil
+}
+
+// objectNamer names the objects of the sources, as listed or walked, in the
+// order the naming flags apply.
+type objectNamer struct {
+	prefix string
+	// renames are the object names of -rename-map by the cleaned source.
+	renames map[string]string
+	flatten bool
+	// strip and add are -strip-prefix and -add-prefix.
+	strip, add string
+	tmpl       *nameTemplate
+	// dir is the directory the sources are relative to, read by tmpl.
+	dir       string
+	names     nameMode
+	normalize normalization
+	redact    *redactor
+	// suffix is appended to the names, e.g. zstdSuffix with -compress.
+	suffix string
+	flat   *flattenNames
+}
+
+// name returns the name of the object of the source f.
+func (n *objectNamer) name(f string) (string, error) {
+	name, err := n.want(f)
+	if err != nil || n.flat == nil {
+		return name, err
+	}
+	return n.flat.Claim(name, f)
+}
+
+// want returns the name the source f wants before -flatten collisions are
+// resolved.
+func (n *objectNamer) want(f string) (string, error) {
+	if obj, ok := n.renames[filepath.Clean(f)]; ok {
+		return n.explicit(obj)
+	}
+	src := f
+	if n.flatten {
+		src = filepath.Base(f)
+	}
+	src, err := objectPath(src, n.strip, n.add)
+	if err != nil {
+		return "", err
+	}
+	if n.tmpl != nil {
+		if src, err = n.tmpl.Execute(src, filepath.Join(n.dir, f)); err != nil {
+			return "", err
+		}
+	}
+	return n.finish(filepath.ToSlash(src))
+}
+
+// explicit returns the name of the object named obj relative to the prefix
+// by -rename-map or a structured list, which is not derived from the source
+// but encoded, normalized, redacted and suffixed like the derived names.
+func (n *objectNamer) explicit(obj string) (string, error) {
+	rel, err := cleanObjectPath(obj)
+	if err != nil {
+		return "", err
+	}
+	return n.finish(rel)
+}
+
+// finish returns the object name of the slash separated path rel.
+func (n *objectNamer) finish(rel string) (string, error) {
+	rel, err := n.names.encode(rel)
+	if err != nil {
+		return "", err
+	}
+	rel = n.normalize.apply(rel)
+	if n.redact != nil {
+		rel = n.redact.redact(rel)
+	}
+	return path.Join(n.prefix, rel) + n.suffix, nil
+}
+
+// encode returns the object name of the local path p.
+func (m nameMode) encode(p string) (string, error) {
+	if m != "raw" {
+		if !utf8.ValidString(p) {
+			return "", fmt.Errorf("invalid UTF-8 in name %q: use -names raw", p)
+		}
+		return p, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(p); {
+		r, size := utf8.DecodeRuneInString(p[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1, r == '%':
+			fmt.Fprintf(&sb, "%%%02X", p[i])
+			i++
+		default:
+			sb.WriteString(p[i : i+size])
+			i += size
+		}
+	}
+	return sb.String(), nil
+}
+
+// decode returns the local path of the object name s. A "%" not followed by
+// two hex digits is kept as it is.
+func (m nameMode) decode(s string) string {
+	if m != "raw" {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			sb.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNameModeRoundTrip(t *testing.T) {
+	for _, p := range []string{
+		"a/b.txt",
+		"caf\xe9/na\xefve",
+		"100%/%41",
+		"日本語/\xff\xfe",
+		"%",
+		"",
+	} {
+		s, err := nameMode("raw").encode(p)
+		if err != nil {
+			t.Errorf("encode(%q): %v", p, err)
+			continue
+		}
+		if !strings.Contains(s, "%") && s != p {
+			t.Errorf("encode(%q) = %q, changed without escaping", p, s)
+		}
+		if got := nameMode("raw").decode(s); got != p {
+			t.Errorf("decode(encode(%q)) = %q (encoded %q)", p, got, s)
+		}
+	}
+}
+
+func TestNameModeRawEncode(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"caf\xe9", "caf%E9"},
+		{"100%", "100%25"},
+		{"日本", "日本"},
+	}
+	for _, tt := range tests {
+		if got, _ := nameMode("raw").encode(tt.in); got != tt.want {
+			t.Errorf("encode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNameModeRawDecodeLoneEscape(t *testing.T) {
+	for _, s := range []string{"a%", "a%4", "a%zz", "%4g"} {
+		if got := nameMode("raw").decode(s); got != s {
+			t.Errorf("decode(%q) = %q, want it unchanged", s, got)
+		}
+	}
+}
+
+func TestNameModeUTF8(t *testing.T) {
+	if _, err := nameMode("utf8").encode("caf\xe9"); err == nil {
+		t.Error("encode of invalid UTF-8 = nil error, want an error")
+	}
+	if got, err := nameMode("utf8").encode("100%"); err != nil || got != "100%" {
+		t.Errorf("encode(100%%) = %q, %v", got, err)
+	}
+}
+
+func TestCheckObjectName(t *testing.T) {
+	for _, name := range []string{"a", "a/b", strings.Repeat("x", maxObjectName)} {
+		if err := checkObjectName(name); err != nil {
+			t.Errorf("checkObjectName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{".", "..", "a\nb", "a\r", strings.Repeat("x", maxObjectName+1)} {
+		if err := checkObjectName(name); err == nil {
+			t.Errorf("checkObjectName(%q) = nil, want an error", name)
+		}
+	}
+}
+
+func TestObjectNamer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses slash separated absolute paths")
+	}
+	tests := []struct {
+		namer objectNamer
+		f     string
+		want  string
+	}{
+		{objectNamer{prefix: "p", names: "utf8"}, "a/b", "p/a/b"},
+		{objectNamer{prefix: "p", names: "utf8"}, "/abs/a/b", "p/abs/a/b"},
+		{objectNamer{prefix: "p", names: "utf8", strip: "/abs"}, "/abs/a/b", "p/a/b"},
+		{objectNamer{prefix: "p", names: "utf8", add: "x/"}, "a", "p/x/a"},
+		{objectNamer{names: "utf8", suffix: zstdSuffix}, "a/b", "a/b.zst"},
+		{objectNamer{prefix: "p", names: "raw"}, "caf\xe9", "p/caf%E9"},
+		{objectNamer{prefix: "p", names: "utf8", normalize: "nfc"}, "café", "p/café"},
+		{objectNamer{prefix: "p", names: "utf8", renames: map[string]string{"a/b": "c"}}, "a//b", "p/c"},
+		{objectNamer{prefix: "p", names: "utf8", flatten: true}, "a/b", "p/b"},
+		{objectNamer{prefix: "p", names: "raw", suffix: zstdSuffix, renames: map[string]string{"a": "/c/%d"}}, "a", "p/c/%25d.zst"},
+	}
+	for _, tt := range tests {
+		got, err := tt.namer.name(tt.f)
+		if err != nil || got != tt.want {
+			t.Errorf("%+v.name(%q) = %q, %v, want %q", tt.namer, tt.f, got, err, tt.want)
+		}
+	}
+}
+
+func TestObjectNamerRejectsEscapingNames(t *testing.T) {
+	n := objectNamer{prefix: "p", names: "utf8", renames: map[string]string{"a": "x/../../b"}}
+	if got, err := n.name("a"); err == nil {
+		t.Errorf("name(a) = %q, want an error for a rename leaving the prefix", got)
+	}
+	for _, obj := range []string{"..", "../b", "a/../../b", "/", "."} {
+		if got, err := n.explicit(obj); err == nil {
+			t.Errorf("explicit(%q) = %q, want an error", obj, got)
+		}
+	}
+	if got, err := n.explicit("/a/../b"); err != nil || got != "p/b" {
+		t.Errorf("explicit(/a/../b) = %q, %v, want p/b", got, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// nameTemplate names the objects of -name-template.
+type nameTemplate struct {
+	t *template.Template
+}
+
+func parseNameTemplate(s string) (*nameTemplate, error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse name template: %w", err)
+	}
+	return &nameTemplate{t: t}, nil
+}
+
+// nameVars are the fields of a -name-template for the file at the slash
+// separated path Path, read from file.
+type nameVars struct {
+	Path    string
+	Dir     string
+	Name    string
+	Base    string
+	Ext     string
+	Size    int64
+	ModTime time.Time
+
+	file string
+}
+
+// Hash returns the hex encoded SHA-256 of the content, reading the file.
+func (v *nameVars) Hash() (string, error) {
+	f, err := os.Open(v.file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Execute returns the object path of the local file at p, read from file.
+func (n *nameTemplate) Execute(p, file string) (string, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("name template: %w", err)
+	}
+	ext := path.Ext(p)
+	v := &nameVars{
+		Path:    p,
+		Dir:     path.Dir(p),
+		Name:    path.Base(p),
+		Base:    strings.TrimSuffix(path.Base(p), ext),
+		Ext:     ext,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		file:    file,
+	}
+	var b strings.Builder
+	if err := n.t.Execute(&b, v); err != nil {
+		return "", fmt.Errorf("name template(%s): %w", p, err)
+	}
+	name, err := cleanObjectPath(b.String())
+	if err != nil {
+		return "", fmt.Errorf("name template(%s): %w", p, err)
+	}
+	return name, nil
+}
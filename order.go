@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"slices"
+)
+
+// shuffleEntries returns the ordering of -order shuffle for the entries of
+// a list, drawn with seed: the same seed shuffles the same list the same
+// way.
+func shuffleEntries(seed int64) func([]string) {
+	return func(entries []string) {
+		rng := rand.New(rand.NewSource(seed))
+		rng.Shuffle(len(entries), func(i, j int) {
+			entries[i], entries[j] = entries[j], entries[i]
+		})
+	}
+}
+
+// sortEntriesBySize returns the ordering of -order largest-first and
+// smallest-first for the entries of a list, whose local paths are given by
+// localPath. Entries that cannot be stat'ed sort as empty files and fail at
+// their upload as usual.
+func sortEntriesBySize(localPath func(string) string, largestFirst bool) func([]string) {
+	return func(entries []string) {
+		sizes := make(map[string]int64, len(entries))
+		for _, e := range entries {
+			if fi, err := os.Stat(localPath(e)); err == nil {
+				sizes[e] = fi.Size()
+			}
+		}
+		slices.SortStableFunc(entries, func(a, b string) int {
+			if largestFirst {
+				a, b = b, a
+			}
+			switch {
+			case sizes[a] < sizes[b]:
+				return -1
+			case sizes[a] > sizes[b]:
+				return 1
+			}
+			return 0
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// checkLocalPath reports why the local path p cannot be opened. Any path
+// can be tried here.
+func checkLocalPath(p string) error {
+	return nil
+}
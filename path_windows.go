@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxPath is the length of the longest relative path Windows opens, MAX_PATH
+// less the terminating NUL. Longer absolute paths are opened by Go with the
+// \\?\ prefix.
+const maxPath = 259
+
+// reservedNames are the device names Windows reserves in every directory,
+// with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkLocalPath reports why Windows cannot open the local path p, instead
+// of the "cannot find the path" of the open. Paths with the \\?\ prefix are
+// passed to the file system as they are and not checked.
+func checkLocalPath(p string) error {
+	if strings.HasPrefix(p, `\\?\`) {
+		return nil
+	}
+	if !filepath.IsAbs(p) && len(utf16.Encode([]rune(p))) > maxPath {
+		return fmt.Errorf("%s: path is longer than %d characters: use an absolute path", p, maxPath)
+	}
+	for _, e := range strings.FieldsFunc(p[len(filepath.VolumeName(p)):], func(r rune) bool { return os.IsPathSeparator(uint8(r)) }) {
+		if i := strings.IndexFunc(e, func(r rune) bool { return r < ' ' || strings.ContainsRune(`<>:"|?*`, r) }); i >= 0 {
+			return fmt.Errorf("%s: reserved character %q in %q", p, e[i], e)
+		}
+		stem, _, _ := strings.Cut(e, ".")
+		if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			return fmt.Errorf("%s: %q is a reserved device name", p, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// writeStage wraps the writer of the next stage, e.g. with a compressor or
+// an encrypter. Closing the returned writer must flush everything it
+// buffered into w but must not close w.
+type writeStage func(w io.Writer) (io.WriteCloser, error)
+
+// pipeline streams a source into an object in a single read pass. Source
+// taps observe the bytes as read from the source (e.g. hashers for
+// verification), stages transform them in order and output taps observe the
+// bytes as stored in the object.
+//
+//	source -> sourceTaps -> stages[0] -> ... -> stages[n-1] -> outputTaps -> object
+type pipeline struct {
+	sourceTaps []io.Writer
+	stages     []writeStage
+	outputTaps []io.Writer
+}
+
+func (p *pipeline) TapSource(w io.Writer) { p.sourceTaps = append(p.sourceTaps, w) }
+func (p *pipeline) TapOutput(w io.Writer) { p.outputTaps = append(p.outputTaps, w) }
+func (p *pipeline) Stage(s writeStage)    { p.stages = append(p.stages, s) }
+
+// Run copies r into dst and returns the number of bytes read from r. dst
+// itself is not closed.
+func (p *pipeline) Run(dst io.Writer, r io.Reader, buf []byte) (int64, error) {
+	if len(p.outputTaps) > 0 {
+		dst = io.MultiWriter(append([]io.Writer{dst}, p.outputTaps...)...)
+	}
+	closers := make([]io.Closer, 0, len(p.stages))
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		w, err := p.stages[i](dst)
+		if err != nil {
+			return 0, fmt.Errorf("stage: %w", err)
+		}
+		closers = append(closers, w)
+		dst = w
+	}
+	if len(p.sourceTaps) > 0 {
+		r = io.TeeReader(r, io.MultiWriter(p.sourceTaps...))
+	}
+	n, err := io.CopyBuffer(dst, r, buf)
+	if err != nil {
+		return n, err
+	}
+	// flush the first stage first, since it writes into the later ones.
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return n, fmt.Errorf("close stage: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// gzipStage compresses the content. The header carries neither a name nor a
+// time, so the same content always compresses to the same bytes.
+func gzipStage(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pluginRequest is sent to the -plugin process for every file as one line
+// of JSON. Size and ModTime are only known for local files.
+type pluginRequest struct {
+	Source  string     `json:"source"`
+	Bucket  string     `json:"bucket"`
+	Object  string     `json:"object"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+// pluginResponse is the answer of the plugin, also one line of JSON. An
+// empty object uploads the file unchanged.
+type pluginResponse struct {
+	// Skip excludes the file from the upload.
+	Skip bool `json:"skip,omitempty"`
+	// Object replaces the object name.
+	Object string `json:"object,omitempty"`
+	// Metadata is added to the custom metadata of the object.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Error fails the file.
+	Error string `json:"error,omitempty"`
+}
+
+// plugin is a long-running process or WebAssembly module deciding the
+// naming, metadata and skipping of files, so that organization specific
+// conventions need no fork. It answers the requests one at a time; a
+// plugin that does not answer within the hook timeout is killed.
+type plugin struct {
+	timeout time.Duration
+	// kill stops the plugin and wait waits for it to exit once its input
+	// is closed, returning nil when it was killed.
+	kill func()
+	wait func() error
+
+	mu     sync.Mutex
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	err    error
+}
+
+// startPlugin starts the shell command of -plugin in the environment of the
+// hooks.
+func startPlugin(ctx context.Context, hooks *hookRunner, command string) (*plugin, error) {
+	cmd, err := hooks.command(ctx, command)
+	if err != nil {
+		return nil, fmt.Errorf("plugin: %w", err)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin: start: %w", err)
+	}
+	wait := func() error {
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && !exitErr.Exited() {
+			// killed by us or by a signal.
+			return nil
+		}
+		return err
+	}
+	return &plugin{
+		timeout: hooks.timeout,
+		kill:    func() { cmd.Cancel() },
+		wait:    wait,
+		stdin:   stdin,
+		stdout:  bufio.NewReader(stdout),
+	}, nil
+}
+
+// Ask sends req and returns the answer of the plugin. Once the plugin has
+// failed, every later call fails too.
+func (p *plugin) Ask(req *pluginRequest) (*pluginResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	resp, err := p.ask(req)
+	if err != nil {
+		p.err = fmt.Errorf("plugin: %w", err)
+		p.kill()
+		return nil, p.err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+func (p *plugin) ask(req *pluginRequest) (*pluginResponse, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var timedOut atomic.Bool
+	if p.timeout > 0 {
+		t := time.AfterFunc(p.timeout, func() {
+			timedOut.Store(true)
+			p.kill()
+		})
+		defer t.Stop()
+	}
+	if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := p.stdout.ReadBytes('\n')
+	if timedOut.Load() {
+		return nil, fmt.Errorf("no answer within %s", p.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("parse answer: %w", err)
+	}
+	return &resp, nil
+}
+
+// Close closes the input of the plugin and waits for it to exit, killing
+// it when it does not exit within the timeout.
+func (p *plugin) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.stdin.Close()
+	var timedOut atomic.Bool
+	if p.timeout > 0 {
+		t := time.AfterFunc(p.timeout, func() {
+			timedOut.Store(true)
+			p.kill()
+		})
+		defer t.Stop()
+	}
+	err := p.wait()
+	switch {
+	case timedOut.Load():
+		return fmt.Errorf("did not exit within %s of the end of its input", p.timeout)
+	case p.err != nil:
+		// killed by us.
+		return nil
+	}
+	return err
+}
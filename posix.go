@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+// metadata keys of -preserve-posix, compatible with gsutil.
+const (
+	metaFileMtime = "goog-reserved-file-mtime"
+	metaPosixMode = "goog-reserved-posix-mode"
+	metaPosixUID  = "goog-reserved-posix-uid"
+	metaPosixGID  = "goog-reserved-posix-gid"
+)
+
+// posixMetadata returns the mtime, mode and owner of a local file as object
+// metadata. The mtime is in seconds and the mode is octal, as gsutil does.
+func posixMetadata(fi fs.FileInfo) map[string]string {
+	md := map[string]string{
+		metaFileMtime: strconv.FormatInt(fi.ModTime().Unix(), 10),
+		metaPosixMode: strconv.FormatUint(uint64(fi.Mode().Perm()), 8),
+	}
+	if mode, uid, gid, ok := fileOwner(fi); ok {
+		md[metaPosixMode] = strconv.FormatUint(uint64(mode&0o7777), 8)
+		md[metaPosixUID] = strconv.FormatUint(uint64(uid), 10)
+		md[metaPosixGID] = strconv.FormatUint(uint64(gid), 10)
+	}
+	return md
+}
+
+// restorePOSIX applies the attributes stored by -preserve-posix to the file
+// name. The owner is only restored when running as root.
+func restorePOSIX(name string, md map[string]string) error {
+	// the owner goes first: chown clears the setuid and setgid bits, even
+	// for root.
+	if os.Geteuid() == 0 {
+		uid, gid := -1, -1
+		if s, ok := md[metaPosixUID]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", metaPosixUID, s)
+			}
+			uid = n
+		}
+		if s, ok := md[metaPosixGID]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", metaPosixGID, s)
+			}
+			gid = n
+		}
+		if uid != -1 || gid != -1 {
+			if err := os.Lchown(name, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	if s, ok := md[metaPosixMode]; ok {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", metaPosixMode, s)
+		}
+		mode := fs.FileMode(m & 0o777)
+		if m&0o4000 != 0 {
+			mode |= fs.ModeSetuid
+		}
+		if m&0o2000 != 0 {
+			mode |= fs.ModeSetgid
+		}
+		if m&0o1000 != 0 {
+			mode |= fs.ModeSticky
+		}
+		if err := os.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+	if s, ok := md[metaFileMtime]; ok {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", metaFileMtime, s)
+		}
+		t := time.Unix(sec, 0)
+		if err := os.Chtimes(name, t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
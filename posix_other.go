@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileOwner reports false: files have no POSIX owner here.
+func fileOwner(fi fs.FileInfo) (mode, uid, gid uint32, ok bool) {
+	return 0, 0, 0, false
+}
+
+// fileInode reports false: hard links are not detected here.
+func fileInode(fi fs.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
+
+// umask returns 0: files have no mode creation mask here.
+func umask() fs.FileMode {
+	return 0
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"sync"
+	"syscall"
+)
+
+// umask returns the file mode creation mask of the process. It is read by
+// setting it, so it is read only once.
+var umask = sync.OnceValue(func() fs.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+	return fs.FileMode(m)
+})
+
+// fileOwner returns the full mode bits and the owner of the file of fi.
+func fileOwner(fi fs.FileInfo) (mode, uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint32(st.Mode), st.Uid, st.Gid, true
+}
+
+// fileInode returns the device, inode and link count of the file of fi.
+func fileInode(fi fs.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink), true
+}
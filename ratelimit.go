@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// opsLimiter limits the number of objects started per second. Following the
+// request rate guidance of GCS, the rate starts at initial and doubles every
+// interval until it reaches max.
+type opsLimiter struct {
+	l        *rate.Limiter
+	start    time.Time
+	initial  float64
+	max      float64
+	interval time.Duration
+}
+
+func newOpsLimiter(max, initial float64, interval time.Duration) *opsLimiter {
+	if initial <= 0 || initial > max || interval <= 0 {
+		initial = max
+	}
+	return &opsLimiter{
+		l:        rate.NewLimiter(rate.Limit(initial), 1),
+		start:    time.Now(),
+		initial:  initial,
+		max:      max,
+		interval: interval,
+	}
+}
+
+// rate returns the rate at now.
+func (o *opsLimiter) rate(now time.Time) float64 {
+	if o.initial >= o.max {
+		return o.max
+	}
+	doublings := math.Floor(float64(now.Sub(o.start)) / float64(o.interval))
+	return math.Min(o.initial*math.Pow(2, doublings), o.max)
+}
+
+// Wait blocks until the next object may be started.
+func (o *opsLimiter) Wait(ctx context.Context) error {
+	if o == nil {
+		return nil
+	}
+	now := time.Now()
+	if r := rate.Limit(o.rate(now)); r != o.l.Limit() {
+		o.l.SetLimitAt(now, r)
+	}
+	return o.l.Wait(ctx)
+}
+
+// bandwidthLimiter limits the aggregate rate of the bytes read by all
+// uploads.
+type bandwidthLimiter struct {
+	l *rate.Limiter
+}
+
+func newBandwidthLimiter(bytesPerSec uint64) *bandwidthLimiter {
+	// a burst of 1/10s keeps the rate smooth without tiny reads.
+	burst := max(int(bytesPerSec/10), 64*1024)
+	return &bandwidthLimiter{l: rate.NewLimiter(rate.Limit(bytesPerSec), burst)}
+}
+
+// Reader returns r limited by b.
+func (b *bandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: b.l}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.l.Burst() {
+		p = p[:t.l.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/yaml.v3"
+)
+
+type redactRule struct {
+	Pattern string `yaml:"pattern"`
+	// Action is either "hash" (default) or "replace".
+	Action  string `yaml:"action"`
+	Replace string `yaml:"replace"`
+
+	re *regexp.Regexp
+}
+
+type redactor struct {
+	rules []redactRule
+	// key is the -redact-key, from which hashKey and mapKey are derived.
+	key     []byte
+	hashKey []byte
+	mapKey  []byte
+
+	mu sync.Mutex
+	// mapping holds the names redacted so far and those of the mapping
+	// file, and pending those not appended to the mapping file yet.
+	mapping map[string]string
+	pending map[string]string
+}
+
+func loadRedactor(rulesFile, keyFile string) (*redactor, error) {
+	b, err := os.ReadFile(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+	var cfg struct {
+		Rules []redactRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse rules(%s): %w", rulesFile, err)
+	}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		switch r.Action {
+		case "":
+			r.Action = "hash"
+		case "hash", "replace":
+		default:
+			return nil, fmt.Errorf("unknown action(%s): %s", r.Pattern, r.Action)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile pattern: %w", err)
+		}
+		r.re = re
+	}
+	key, err := readRedactKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, mapKey, err := deriveRedactKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	return &redactor{
+		rules:   cfg.Rules,
+		key:     key,
+		hashKey: hashKey,
+		mapKey:  mapKey,
+		mapping: map[string]string{},
+		pending: map[string]string{},
+	}, nil
+}
+
+// deriveRedactKeys derives the keys of the name hashes and of the mapping
+// from key with HKDF, so that neither use of the key weakens the other.
+func deriveRedactKeys(key []byte) (hashKey, mapKey []byte, err error) {
+	derive := func(info string) ([]byte, error) {
+		k := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), k); err != nil {
+			return nil, fmt.Errorf("derive redact key: %w", err)
+		}
+		return k, nil
+	}
+	if hashKey, err = derive("gcs-upload redact name hmac-sha256"); err != nil {
+		return nil, nil, err
+	}
+	if mapKey, err = derive("gcs-upload redact mapping aes-256-gcm"); err != nil {
+		return nil, nil, err
+	}
+	return hashKey, mapKey, nil
+}
+
+func readRedactKey(name string) ([]byte, error) {
+	if name == "" {
+		return nil, fmt.Errorf("redact key not found: please use -redact-key")
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read redact key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decode redact key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("redact key must be 32 bytes: got %d", len(key))
+	}
+	return key, nil
+}
+
+// redact rewrites every component of the slash-separated path p that matches
+// one of the rules. Hashes are keyed so that low-entropy values such as SSNs
+// cannot be recovered by brute force without the key.
+func (r *redactor) redact(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		for _, rule := range r.rules {
+			switch rule.Action {
+			case "hash":
+				part = rule.re.ReplaceAllStringFunc(part, r.hash)
+			case "replace":
+				part = rule.re.ReplaceAllString(part, rule.Replace)
+			}
+		}
+		parts[i] = part
+	}
+	redacted := strings.Join(parts, "/")
+	if redacted != p {
+		r.mu.Lock()
+		if r.mapping[redacted] != p {
+			r.mapping[redacted] = p
+			r.pending[redacted] = p
+		}
+		r.mu.Unlock()
+	}
+	return redacted
+}
+
+func (r *redactor) hash(s string) string {
+	h := hmac.New(sha256.New, r.hashKey)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// redactMapMagic starts the mapping files: lines of base64 encoded records,
+// each the nonce and the AES-256-GCM sealed JSON of the entries added since
+// the previous one, so that the mapping is appended to as the uploads go.
+// Files of earlier versions are a single binary record sealed with the key
+// itself.
+const redactMapMagic = "gcs-upload redact map v2\n"
+
+// openMapping reads the mapping file name, if any, so that the names it
+// holds are not appended again, and converts one of an earlier version.
+func (r *redactor) openMapping(name string) error {
+	m, legacy, err := readMapping(name, r.key, r.mapKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	maps.Copy(r.mapping, m)
+	if !legacy {
+		return nil
+	}
+	rec, err := r.seal(m)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(redactMapMagic+rec+"\n"), 0o600); err != nil {
+		return fmt.Errorf("write mapping: %w", err)
+	}
+	return os.Rename(tmp, name)
+}
+
+// appendMapping appends the names redacted since the previous call to the
+// mapping file name.
+func (r *redactor) appendMapping(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) == 0 {
+		return nil
+	}
+	rec, err := r.seal(r.pending)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open mapping: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat mapping: %w", err)
+	}
+	if fi.Size() == 0 {
+		rec = redactMapMagic + rec
+	}
+	if _, err := f.WriteString(rec + "\n"); err != nil {
+		return fmt.Errorf("write mapping: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write mapping: %w", err)
+	}
+	r.pending = map[string]string{}
+	return nil
+}
+
+// seal returns the record of the entries m.
+func (r *redactor) seal(m map[string]string) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("marshal mapping: %w", err)
+	}
+	aead, err := newRedactAEAD(r.mapKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, b, nil)), nil
+}
+
+// readRedactMapping reads the mapping file name written with key.
+func readRedactMapping(name string, key []byte) (map[string]string, error) {
+	_, mapKey, err := deriveRedactKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := readMapping(name, key, mapKey)
+	return m, err
+}
+
+// readMapping reads the mapping file name, merging its records, and reports
+// whether it is of an earlier version, sealed with legacyKey.
+func readMapping(name string, legacyKey, mapKey []byte) (map[string]string, bool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false, fmt.Errorf("read mapping: %w", err)
+	}
+	rest, ok := bytes.CutPrefix(b, []byte(redactMapMagic))
+	if !ok {
+		m, err := openMappingRecord(b, legacyKey)
+		return m, true, err
+	}
+	m := map[string]string{}
+	for i, line := range strings.Split(strings.TrimSpace(string(rest)), "\n") {
+		if line == "" {
+			continue
+		}
+		rec, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, false, fmt.Errorf("mapping record %d: %w", i+1, err)
+		}
+		rm, err := openMappingRecord(rec, mapKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("mapping record %d: %w", i+1, err)
+		}
+		maps.Copy(m, rm)
+	}
+	return m, false, nil
+}
+
+// openMappingRecord decrypts the record b sealed with key.
+func openMappingRecord(b, key []byte) (map[string]string, error) {
+	aead, err := newRedactAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("mapping too short")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt mapping: %w", err)
+	}
+	var m map[string]string
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal mapping: %w", err)
+	}
+	return m, nil
+}
+
+func newRedactAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+	return aead, nil
+}
+
+func runRedactMap(args []string) error {
+	cmd := flag.NewFlagSet("redact-map", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload redact-map <mapping-file>:\n")
+		cmd.PrintDefaults()
+	}
+	keyFile := cmd.String("redact-key", "", "file containing the base64 encoded 32-byte key")
+	cmd.Parse(args)
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("invalid args")
+	}
+	key, err := readRedactKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	m, err := readRedactMapping(cmd.Arg(0), key)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
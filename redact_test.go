@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func newTestRedactor(t *testing.T, key []byte) *redactor {
+	t.Helper()
+	hashKey, mapKey, err := deriveRedactKeys(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &redactor{
+		rules:   []redactRule{{Action: "hash", re: regexp.MustCompile(`secret\d`)}},
+		key:     key,
+		hashKey: hashKey,
+		mapKey:  mapKey,
+		mapping: map[string]string{},
+		pending: map[string]string{},
+	}
+}
+
+func TestRedactMappingAppends(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	name := filepath.Join(t.TempDir(), "mapping.enc")
+
+	r := newTestRedactor(t, key)
+	if err := r.openMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	a := r.redact("d/secret1")
+	if err := r.appendMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	b := r.redact("d/secret2")
+	if err := r.appendMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	// a later run adds to the mapping instead of replacing it.
+	r = newTestRedactor(t, key)
+	if err := r.openMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	c := r.redact("d/secret3")
+	r.redact("d/secret1")
+	if err := r.appendMapping(name); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readRedactMapping(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{a: "d/secret1", b: "d/secret2", c: "d/secret3"}
+	if len(m) != len(want) {
+		t.Errorf("mapping = %v, want %v", m, want)
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("mapping[%s] = %q, want %q", k, m[k], v)
+		}
+	}
+}
+
+func TestRedactMappingLegacy(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	name := filepath.Join(t.TempDir(), "mapping.enc")
+	// the single record sealed with the key itself of earlier versions.
+	aead, err := newRedactAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	b, _ := json.Marshal(map[string]string{"old": "d/old"})
+	if err := os.WriteFile(name, aead.Seal(nonce, nonce, b, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRedactor(t, key)
+	if err := r.openMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	r.redact("d/secret1")
+	if err := r.appendMapping(name); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readRedactMapping(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["old"] != "d/old" || len(m) != 2 {
+		t.Errorf("mapping = %v, want the legacy entry and the new one", m)
+	}
+}
+
+func TestRedactKeysDiffer(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	hashKey, mapKey, err := deriveRedactKeys(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hashKey, key) || bytes.Equal(mapKey, key) || bytes.Equal(hashKey, mapKey) {
+		t.Error("the derived keys are not distinct from each other and the key")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// replica is a destination of -replicas, which gets a copy of every object
+// uploaded to dest.
+type replica struct {
+	bucket string
+	prefix string
+}
+
+// parseReplicas parses the gs://bucket or gs://bucket/prefix URLs of the
+// replicas.
+func parseReplicas(urls []string) ([]replica, error) {
+	var replicas []replica
+	for _, s := range urls {
+		u, err := url.ParseRequestURI(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse replica: %w", err)
+		}
+		if u.Scheme != "gs" || u.Host == "" {
+			return nil, fmt.Errorf("replica must be gs://bucket or gs://bucket/prefix: %s", s)
+		}
+		replicas = append(replicas, replica{bucket: u.Host, prefix: objectPrefix(u)})
+	}
+	return replicas, nil
+}
+
+// name returns the name in the replica of the object name below prefix in
+// dest.
+func (r replica) name(prefix, name string) string {
+	if prefix != "" {
+		name = strings.TrimPrefix(name, prefix+"/")
+	}
+	return path.Join(r.prefix, name)
+}
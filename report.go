@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var errInterrupted = errors.New("interrupted by signal")
+
+// reportEntry describes a list entry that was not uploaded. Status is one of
+// failed, canceled, not-started or skipped; Reason tells operators whether
+// the entry is safe to retry blindly: error, sibling-failure, signal or
+// deadline, or append-only for an existing object that a retention policy or
+// hold prevents from being overwritten, no-clobber for one kept by
+// -no-clobber and empty for an empty file skipped by -skip-empty.
+type reportEntry struct {
+	Source string `json:"source"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+type reportWriter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func createReport(name string) (*reportWriter, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("create report: %w", err)
+	}
+	return &reportWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Failed records an entry whose upload returned err.
+func (r *reportWriter) Failed(ctx context.Context, source string, err error) error {
+	e := &reportEntry{Source: source, Status: "failed", Reason: "error", Error: err.Error()}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		e.Status = "canceled"
+		e.Reason = cancelReason(ctx, err)
+	}
+	return r.write(e)
+}
+
+// NotStarted records an entry skipped because the run was canceled.
+func (r *reportWriter) NotStarted(ctx context.Context, source string) error {
+	return r.write(&reportEntry{Source: source, Status: "not-started", Reason: cancelReason(ctx, nil)})
+}
+
+// Unprocessed records an entry not started because the run stopped for
+// reason, the deadline or the budget of -max-files or -max-total-bytes.
+func (r *reportWriter) Unprocessed(source, reason string) error {
+	return r.write(&reportEntry{Source: source, Status: "not-started", Reason: reason})
+}
+
+// Skipped records an entry intentionally not uploaded for reason.
+func (r *reportWriter) Skipped(source, reason string) error {
+	return r.write(&reportEntry{Source: source, Status: "skipped", Reason: reason})
+}
+
+func (r *reportWriter) write(e *reportEntry) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+func (r *reportWriter) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+func cancelReason(ctx context.Context, err error) string {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errInterrupted):
+		return "signal"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(cause, context.DeadlineExceeded):
+		return "deadline"
+	case cause != nil:
+		return "sibling-failure"
+	}
+	return "error"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// appendOnlyReason returns why existing objects of bucket cannot be
+// overwritten or deleted, or "" when nothing prevents it. Holds placed on
+// individual objects are not detected.
+func appendOnlyReason(ctx context.Context, bucket *storage.BucketHandle) (string, error) {
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return "", fmt.Errorf("bucket attrs(gs://%s): %w", bucket.BucketName(), err)
+	}
+	var reasons []string
+	if p := attrs.RetentionPolicy; p != nil && p.RetentionPeriod > 0 {
+		r := fmt.Sprintf("retention policy of %s", p.RetentionPeriod)
+		if p.IsLocked {
+			r += " (locked)"
+		}
+		reasons = append(reasons, r)
+	}
+	if attrs.DefaultEventBasedHold {
+		reasons = append(reasons, "default event-based hold")
+	}
+	return strings.Join(reasons, " and "), nil
+}
+
+// checkAppendOnly runs the preflight of appendOnlyReason and warns about what
+// will be done differently. A bucket whose attrs cannot be read is assumed
+// not to be append-only.
+func checkAppendOnly(ctx context.Context, bucket *storage.BucketHandle) bool {
+	reason, err := appendOnlyReason(ctx, bucket)
+	if err != nil {
+		log.Printf("preflight: %v", err)
+		return false
+	}
+	if reason == "" {
+		return false
+	}
+	log.Printf("warning: gs://%s has a %s: existing objects cannot be overwritten or deleted, so they are skipped and only new objects are created", bucket.BucketName(), reason)
+	return true
+}
+
+// isPreconditionFailed reports whether err is the rejection of a request
+// whose preconditions did not hold.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// objectRetention is the retention configuration of -retention-mode, set on
+// every new object. Its retain-until time is either fixed or computed from
+// the time each object is written.
+type objectRetention struct {
+	mode   string
+	until  time.Time
+	period time.Duration
+}
+
+// parseObjectRetention parses the retention flags. It returns nil if mode is
+// empty.
+func parseObjectRetention(mode, until, period string) (*objectRetention, error) {
+	if mode == "" {
+		if until != "" || period != "" {
+			return nil, fmt.Errorf("-retain-until and -retain-for require -retention-mode")
+		}
+		return nil, nil
+	}
+	r := &objectRetention{}
+	switch strings.ToLower(mode) {
+	case "unlocked":
+		r.mode = "Unlocked"
+	case "locked":
+		r.mode = "Locked"
+	default:
+		return nil, fmt.Errorf("unknown retention mode: %s", mode)
+	}
+	switch {
+	case until != "" && period != "":
+		return nil, fmt.Errorf("cannot use both -retain-until and -retain-for")
+	case until != "":
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, fmt.Errorf("parse retain until: %w", err)
+		}
+		r.until = t
+	case period != "":
+		d, err := parseAge(period)
+		if err != nil {
+			return nil, err
+		}
+		r.period = d
+	default:
+		return nil, fmt.Errorf("-retention-mode requires -retain-until or -retain-for")
+	}
+	return r, nil
+}
+
+// retention returns the retention of an object written at now.
+func (r *objectRetention) retention(now time.Time) *storage.ObjectRetention {
+	if r == nil {
+		return nil
+	}
+	until := r.until
+	if r.period > 0 {
+		until = now.Add(r.period)
+	}
+	return &storage.ObjectRetention{Mode: r.mode, RetainUntil: until}
+}
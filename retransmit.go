@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errTooManyRetransmits = errors.New("too many retransmitted bytes")
+
+type retransmitKey struct{}
+
+// retransmitTracker accounts the bytes sent for one object. Resumable
+// uploads carry their offsets in Content-Range, so a chunk resent after a
+// failure is detected precisely; a single-request upload is retransmitted
+// as a whole.
+type retransmitTracker struct {
+	// ratio aborts the upload once the retransmitted bytes exceed this
+	// ratio of the object size. 0 means no limit.
+	ratio    float64
+	expected int64
+
+	mu            sync.Mutex
+	sent          int64
+	retransmitted int64
+	end           int64
+	requests      int
+}
+
+func withRetransmitTracker(ctx context.Context, t *retransmitTracker) context.Context {
+	return context.WithValue(ctx, retransmitKey{}, t)
+}
+
+func (t *retransmitTracker) observe(req *http.Request) error {
+	if req.ContentLength <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if start, end, ok := parseContentRange(req.Header.Get("Content-Range")); ok {
+		if start < t.end {
+			t.retransmitted += min(end, t.end) - start
+		}
+		t.end = max(t.end, end)
+	} else {
+		if t.requests > 0 {
+			t.retransmitted += req.ContentLength
+		}
+		t.end = max(t.end, req.ContentLength)
+	}
+	t.requests++
+	t.sent += req.ContentLength
+	if t.ratio > 0 && float64(t.retransmitted) > t.ratio*float64(max(t.expected, t.end)) {
+		return fmt.Errorf("%w: %d of %d bytes", errTooManyRetransmits, t.retransmitted, max(t.expected, t.end))
+	}
+	return nil
+}
+
+func (t *retransmitTracker) Retransmitted() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.retransmitted
+}
+
+// parseContentRange parses "bytes start-last/total" and returns the
+// half-open range [start, end).
+func parseContentRange(s string) (int64, int64, bool) {
+	s, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	r, _, _ := strings.Cut(s, "/")
+	first, last, ok := strings.Cut(r, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end + 1, true
+}
+
+// retransmitTransport reports the upload requests to the tracker found in
+// their context and fails them once the tracker's limit is exceeded.
+type retransmitTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retransmitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, ok := req.Context().Value(retransmitKey{}).(*retransmitTracker); ok && strings.Contains(req.URL.Path, "/upload/") {
+		if err := tr.observe(req); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Source streams objects below an s3://bucket/prefix URL. It works with
+// AWS S3 and any S3-compatible endpoint.
+type s3Source struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Source(src *url.URL, endpoint, region string) (*s3Source, error) {
+	secure := true
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		secure = u.Scheme != "http"
+		endpoint = u.Host
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+	prefix := strings.TrimPrefix(src.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Source{client: client, bucket: src.Host, prefix: prefix}, nil
+}
+
+// writeListFile lists every object below the prefix and writes its key,
+// relative to the prefix, to a temporary list file.
+func (s *s3Source) writeListFile(ctx context.Context) (string, error) {
+	f, err := os.CreateTemp("", "")
+	if err != nil {
+		return "", fmt.Errorf("create list file: %w", err)
+	}
+	defer f.Close()
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix,
+		Recursive: true,
+	})
+	for o := range objects {
+		if o.Err != nil {
+			return f.Name(), fmt.Errorf("list(s3://%s/%s): %w", s.bucket, s.prefix, o.Err)
+		}
+		// skip the zero-byte "directory" markers created by some tools.
+		if strings.HasSuffix(o.Key, "/") {
+			continue
+		}
+		if _, err := f.WriteString(strings.TrimPrefix(o.Key, s.prefix) + "\n"); err != nil {
+			return f.Name(), fmt.Errorf("write path: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return f.Name(), fmt.Errorf("close list file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func (s *s3Source) Open(ctx context.Context, name string) (sourceFile, error) {
+	o, err := s.client.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get object(s3://%s/%s%s): %w", s.bucket, s.prefix, name, err)
+	}
+	return &s3File{Object: o}, nil
+}
+
+type s3File struct {
+	*minio.Object
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	info, err := f.Object.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{name: info.Key, size: info.Size, modTime: info.LastModified}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sampleRate is the -sample flag: the fraction of the list entries to
+// upload, given as a percentage such as 1% or as a fraction such as 0.01.
+type sampleRate float64
+
+func (r *sampleRate) String() string {
+	return strconv.FormatFloat(float64(*r)*100, 'g', -1, 64) + "%"
+}
+
+func (r *sampleRate) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("parse(%s): %w", s, err)
+	}
+	if strings.HasSuffix(s, "%") {
+		v /= 100
+	}
+	if v <= 0 || v > 1 {
+		return fmt.Errorf("parse(%s): must be between 0%% and 100%%", s)
+	}
+	*r = sampleRate(v)
+	return nil
+}
+
+// sampled reports whether the entry is in the sample of rate drawn with
+// seed. It depends on nothing but the entry and the seed, so that the same
+// seed samples the same entries in any order.
+func sampled(entry string, rate float64, seed int64) bool {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, seed)
+	io.WriteString(h, entry)
+	return float64(binary.LittleEndian.Uint64(h.Sum(nil))>>11)/(1<<53) < rate
+}
+
+// sampleListFile writes k entries of listFile read with newScanner, chosen
+// at random with rng, to a temporary file in their order in the list,
+// terminated by delim.
+func sampleListFile(listFile string, newScanner func(io.Reader) listScanner, delim byte, k int, rng *rand.Rand) (string, error) {
+	f, err := openFile(listFile)
+	if err != nil {
+		return "", fmt.Errorf("open list file: %w", err)
+	}
+	defer f.Close()
+
+	type entry struct {
+		i    int
+		name string
+	}
+	var sample []entry
+	s := newScanner(f)
+	for i := 0; s.Scan(); i++ {
+		switch {
+		case i < k:
+			sample = append(sample, entry{i, s.Text()})
+		// reservoir sampling keeps every entry with the probability k/(i+1).
+		default:
+			if j := rng.Intn(i + 1); j < k {
+				sample[j] = entry{i, s.Text()}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("scan list file: %w", err)
+	}
+	_ = f.Close()
+	slices.SortFunc(sample, func(a, b entry) int { return a.i - b.i })
+
+	tf, err := os.CreateTemp("", "")
+	if err != nil {
+		return "", fmt.Errorf("create list file: %w", err)
+	}
+	defer tf.Close()
+
+	for _, e := range sample {
+		if _, err := tf.WriteString(e.name + string(delim)); err != nil {
+			return "", fmt.Errorf("write path: %w", err)
+		}
+	}
+	if err := tf.Close(); err != nil {
+		return "", fmt.Errorf("close list file: %w", err)
+	}
+	return tf.Name(), nil
+}
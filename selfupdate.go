@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// version is set by goreleaser.
+var version = "dev"
+
+// releasePublicKey is the minisign public key the checksums.txt of the
+// releases are signed with, set by goreleaser from MINISIGN_PUBLIC_KEY.
+var releasePublicKey = ""
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// runSelfUpdate replaces the running binary with the latest GitHub release
+// after checking the minisign signature of the checksums.txt of the release
+// and the archive against the SHA-256 in it. The checksums alone come from
+// the same release as the archive and would not detect tampering.
+func runSelfUpdate(args []string) error {
+	cmd := flag.NewFlagSet("self-update", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload self-update:\n")
+		cmd.PrintDefaults()
+	}
+	repo := cmd.String("repo", "orisano/gcs-upload", "GitHub repository to update from")
+	check := cmd.Bool("check", false, "only report whether an update is available")
+	force := cmd.Bool("force", false, "update even if the binary is the latest release or a development build")
+	publicKey := cmd.String("public-key", releasePublicKey, "minisign public key the checksums.txt of the releases is signed with")
+	cmd.Parse(args)
+
+	ctx := context.Background()
+	var rel githubRelease
+	if err := getJSON(ctx, "https://api.github.com/repos/"+*repo+"/releases/latest", &rel); err != nil {
+		return fmt.Errorf("latest release: %w", err)
+	}
+	latest := strings.TrimPrefix(rel.TagName, "v")
+	if latest == version && !*force {
+		log.Printf("already up to date: %s", version)
+		return nil
+	}
+	if *check {
+		log.Printf("update available: %s -> %s", version, latest)
+		return nil
+	}
+	if version == "dev" && !*force {
+		return fmt.Errorf("development build: use -force to replace it with %s", latest)
+	}
+
+	if *publicKey == "" {
+		return fmt.Errorf("no public key to verify the release with: use -public-key")
+	}
+	pub, err := parseMinisignPublicKey(*publicKey)
+	if err != nil {
+		return err
+	}
+	archive, err := releaseArchiveName()
+	if err != nil {
+		return err
+	}
+	assets := map[string]string{}
+	for _, a := range rel.Assets {
+		assets[a.Name] = a.URL
+	}
+	if assets[archive] == "" || assets["checksums.txt"] == "" || assets["checksums.txt.minisig"] == "" {
+		return fmt.Errorf("release %s has no %s, checksums.txt or checksums.txt.minisig", rel.TagName, archive)
+	}
+	sums, err := fetchChecksums(ctx, assets["checksums.txt"], assets["checksums.txt.minisig"], pub)
+	if err != nil {
+		return fmt.Errorf("checksums: %w", err)
+	}
+	if sums[archive] == "" {
+		return fmt.Errorf("checksums.txt has no %s", archive)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Dir(exe), ".gcs-upload-*")
+	if err != nil {
+		return fmt.Errorf("create binary: %w", err)
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+	if err := fetchBinary(ctx, assets[archive], sums[archive], tf); err != nil {
+		return fmt.Errorf("download %s: %w", archive, err)
+	}
+	if err := tf.Chmod(0o755); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tf.Name(), exe); err != nil {
+		return fmt.Errorf("replace binary: %w", err)
+	}
+	log.Printf("updated: %s -> %s", version, latest)
+	return nil
+}
+
+// releaseArchiveName returns the name of the archive built by goreleaser
+// for this platform.
+func releaseArchiveName() (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("no releases for %s", runtime.GOOS)
+	}
+	switch runtime.GOARCH {
+	case "amd64":
+		return "gcs-upload_Linux_x86_64.tar.gz", nil
+	case "arm64":
+		return "gcs-upload_Linux_arm64.tar.gz", nil
+	}
+	return "", fmt.Errorf("no releases for %s", runtime.GOARCH)
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchChecksums parses a "<sha256>  <name>" per line checksums file after
+// checking its minisign signature at sigURL with pub.
+func fetchChecksums(ctx context.Context, url, sigURL string, pub *minisignPublicKey) (map[string]string, error) {
+	b, err := fetchAll(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetchAll(ctx, sigURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := pub.Verify(b, sig); err != nil {
+		return nil, fmt.Errorf("verify signature: %w", err)
+	}
+	sums := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) == 2 {
+			sums[fields[1]] = fields[0]
+		}
+	}
+	return sums, s.Err()
+}
+
+// fetchAll returns the body at url, of at most 1 MiB.
+func fetchAll(ctx context.Context, url string) ([]byte, error) {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// fetchBinary extracts the gcs-upload binary of the archive at url into w.
+// The whole archive is hashed before it is trusted, so w must be discarded
+// on error.
+func fetchBinary(ctx context.Context, url, sha string, w io.Writer) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	zr, err := gzip.NewReader(io.TeeReader(resp.Body, h))
+	if err != nil {
+		return err
+	}
+	found := false
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == "gcs-upload" {
+			if _, err := io.Copy(w, tr); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	// the rest of the stream, e.g. gzip padding, is part of the checksum.
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		return fmt.Errorf("sha256 mismatch: %s, want %s", got, sha)
+	}
+	if !found {
+		return fmt.Errorf("no gcs-upload binary in the archive")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// shardValue is the -shard flag i/N: the entries of the list in shard i of
+// N, numbered from 0.
+type shardValue struct {
+	i, n int
+}
+
+func (s *shardValue) String() string {
+	if s.n == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.i) + "/" + strconv.Itoa(s.n)
+}
+
+func (s *shardValue) Set(v string) error {
+	is, ns, ok := strings.Cut(v, "/")
+	i, err1 := strconv.Atoi(is)
+	n, err2 := strconv.Atoi(ns)
+	if !ok || err1 != nil || err2 != nil || n < 1 || i < 0 || i >= n {
+		return fmt.Errorf("parse(%s): must be i/N with 0 <= i < N", v)
+	}
+	s.i, s.n = i, n
+	return nil
+}
+
+// Has reports whether the entry is in the shard. The shard of an entry is
+// given by the hash of its path alone, without the generation of
+// -list-generations, so that every machine running a shard of the same list
+// agrees on it.
+func (s *shardValue) Has(entry string) bool {
+	if s.n == 0 {
+		return true
+	}
+	h := fnv.New64a()
+	io.WriteString(h, entry)
+	return h.Sum64()%uint64(s.n) == uint64(s.i)
+}
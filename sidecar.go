@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+// sidecarSuffix names the file holding the attributes of the file it is
+// appended to, e.g. photo.jpg.gcsmeta for photo.jpg.
+const sidecarSuffix = ".gcsmeta"
+
+// objectMeta holds the attributes of a single object given by a sidecar
+// file or the plugin. They take precedence over the flags.
+type objectMeta struct {
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ContentLanguage    string            `json:"content_language,omitempty"`
+	ACL                []objectACLRule   `json:"acl,omitempty"`
+}
+
+type objectACLRule struct {
+	Entity string `json:"entity"`
+	Role   string `json:"role"`
+}
+
+// readSidecar reads the sidecar of the file name. A missing sidecar is not
+// an error and returns nil.
+func readSidecar(name string) (*objectMeta, error) {
+	b, err := os.ReadFile(name + sidecarSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read sidecar: %w", err)
+	}
+	var m objectMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parse sidecar(%s%s): %w", name, sidecarSuffix, err)
+	}
+	return &m, nil
+}
+
+// addMetadata merges md into the metadata of m, allocating m if needed.
+func (m *objectMeta) addMetadata(md map[string]string) *objectMeta {
+	if len(md) == 0 {
+		return m
+	}
+	if m == nil {
+		m = &objectMeta{}
+	}
+	if m.Metadata == nil {
+		m.Metadata = map[string]string{}
+	}
+	maps.Copy(m.Metadata, md)
+	return m
+}
+
+// applyHeaders overrides the attributes of attrs other than the metadata.
+func (m *objectMeta) applyHeaders(attrs *storage.ObjectAttrs) {
+	if m == nil {
+		return
+	}
+	if m.ContentType != "" {
+		attrs.ContentType = m.ContentType
+	}
+	if m.CacheControl != "" {
+		attrs.CacheControl = m.CacheControl
+	}
+	if m.ContentDisposition != "" {
+		attrs.ContentDisposition = m.ContentDisposition
+	}
+	if m.ContentLanguage != "" {
+		attrs.ContentLanguage = m.ContentLanguage
+	}
+	for _, r := range m.ACL {
+		attrs.ACL = append(attrs.ACL, storage.ACLRule{Entity: storage.ACLEntity(r.Entity), Role: storage.ACLRole(r.Role)})
+	}
+}
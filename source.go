@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// sourceFile is an opened file to be uploaded, local or remote.
+type sourceFile interface {
+	io.ReadCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// objectInfo describes a remote object as a fs.FileInfo.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o *objectInfo) Name() string       { return path.Base(o.name) }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) Mode() fs.FileMode  { return 0o444 }
+func (o *objectInfo) ModTime() time.Time { return o.modTime }
+func (o *objectInfo) IsDir() bool        { return false }
+func (o *objectInfo) Sys() any           { return nil }
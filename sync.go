@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// syncState is what both sides looked like after the last successful sync.
+type syncState struct {
+	Files map[string]syncStateEntry `json:"files"`
+}
+
+type syncStateEntry struct {
+	ModTime    int64 `json:"mtime"`
+	Size       int64 `json:"size"`
+	Generation int64 `json:"generation"`
+}
+
+type syncLocal struct {
+	modTime time.Time
+	size    int64
+}
+
+type syncRemote struct {
+	generation int64
+	updated    time.Time
+	size       int64
+	crc32c     uint32
+}
+
+type syncAction int
+
+const (
+	syncNone syncAction = iota
+	syncUpload
+	syncDownload
+	syncDeleteLocal
+	syncDeleteRemote
+	// syncSkip leaves a conflict unresolved for the next sync.
+	syncSkip
+)
+
+func (a syncAction) String() string {
+	switch a {
+	case syncUpload:
+		return "upload"
+	case syncDownload:
+		return "download"
+	case syncDeleteLocal:
+		return "delete local"
+	case syncDeleteRemote:
+		return "delete remote"
+	case syncSkip:
+		return "conflict (skipped)"
+	}
+	return "none"
+}
+
+func runSync(args []string) error {
+	cmd := flag.NewFlagSet("sync", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload sync -d <dir> -state <file> <dest>:\n")
+		cmd.PrintDefaults()
+	}
+	n := cmd.Int("n", 24, "number of goroutines for transfers")
+	verbose := cmd.Bool("v", false, "show verbose output")
+	dir := cmd.String("d", "", "local directory to be synchronized")
+	statePath := cmd.String("state", "", "state file recording the result of the previous sync")
+	conflict := cmd.String("conflict", "newer", "policy for files changed on both sides: newer, local, remote or skip")
+	propagateDeletes := cmd.Bool("delete", false, "propagate deletions of files removed since the previous sync")
+	chunkSize := flagBytesSet(cmd, "chunk", 16*1024*1024, "upload chunk size")
+	dryRun := cmd.Bool("dry-run", false, "show what would be transferred without doing it")
+	namesFlag := cmd.String("names", "utf8", "how paths become object names: utf8 or raw (percent-encode bytes that are not UTF-8)")
+	cmd.Parse(args)
+
+	if cmd.NArg() != 1 || *dir == "" || *statePath == "" {
+		cmd.Usage()
+		return fmt.Errorf("invalid args")
+	}
+	names, err := parseNameMode(*namesFlag)
+	if err != nil {
+		return err
+	}
+	switch *conflict {
+	case "newer", "local", "remote", "skip":
+	default:
+		return fmt.Errorf("unknown conflict policy: %s", *conflict)
+	}
+	dest, err := url.ParseRequestURI(cmd.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse dest: %w", err)
+	}
+	if dest.Scheme != "gs" || dest.Host == "" {
+		return fmt.Errorf("dest must be gs://bucket or gs://bucket/prefix: %s", dest)
+	}
+	prefix := objectPrefix(dest)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	state, err := readSyncState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	gcs, err := newStorageClient(ctx, clientConfig{})
+	if err != nil {
+		return fmt.Errorf("storage client: %w", err)
+	}
+	bucket := gcs.Bucket(dest.Hostname())
+
+	locals, err := scanSyncLocal(*dir, names)
+	if err != nil {
+		return err
+	}
+	remotes, err := scanSyncRemote(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	appendOnly := checkAppendOnly(ctx, bucket)
+
+	st := &syncer{
+		dir:       *dir,
+		bucket:    bucket,
+		prefix:    prefix,
+		chunkSize: int(*chunkSize),
+		names:     names,
+		next:      map[string]syncStateEntry{},
+	}
+
+	var protected int
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(*n)
+	for _, rel := range unionKeys(locals, remotes) {
+		l, hasLocal := locals[rel]
+		r, hasRemote := remotes[rel]
+		prev, inState := state.Files[rel]
+		action := decideSync(*dir, names.decode(rel), l, hasLocal, r, hasRemote, prev, inState, *conflict, *propagateDeletes)
+		switch action {
+		case syncNone:
+			if hasLocal && hasRemote {
+				st.record(rel, l, r.generation)
+			}
+			continue
+		case syncUpload, syncDeleteRemote:
+			// a protected object can neither be replaced nor deleted.
+			if appendOnly && hasRemote {
+				log.Printf("%s (append-only, skipped): %s", action, rel)
+				protected++
+				st.keep(rel, prev, inState)
+				continue
+			}
+		case syncSkip:
+			log.Printf("%s: %s", action, rel)
+			st.keep(rel, prev, inState)
+			continue
+		}
+		if *dryRun || *verbose {
+			log.Printf("%s: %s", action, rel)
+		}
+		if *dryRun {
+			continue
+		}
+		eg.Go(func() error {
+			// a failed path is decided again by the next sync.
+			if err := st.apply(egCtx, action, rel, r, hasRemote); err != nil {
+				st.keep(rel, prev, inState)
+				return err
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		// the transfers that succeeded are recorded all the same, so that
+		// the next sync does not take them for changes of both sides.
+		if !*dryRun {
+			if werr := writeSyncState(*statePath, &syncState{Files: st.next}); werr != nil {
+				err = errors.Join(err, werr)
+			}
+		}
+		return fmt.Errorf("sync: %w", err)
+	}
+	if protected > 0 {
+		log.Printf("append-only: %d remote objects were left unchanged", protected)
+	}
+	if *dryRun {
+		return nil
+	}
+	return writeSyncState(*statePath, &syncState{Files: st.next})
+}
+
+// decideSync reconciles one path. A side has changed when it differs from
+// the state recorded by the previous sync.
+func decideSync(dir, rel string, l syncLocal, hasLocal bool, r syncRemote, hasRemote bool, prev syncStateEntry, inState bool, conflict string, propagateDeletes bool) syncAction {
+	localChanged := !inState || l.modTime.UnixNano() != prev.ModTime || l.size != prev.Size
+	remoteChanged := !inState || r.generation != prev.Generation
+	switch {
+	case hasLocal && !hasRemote:
+		if inState && !localChanged && propagateDeletes {
+			return syncDeleteLocal
+		}
+		return syncUpload
+	case !hasLocal && hasRemote:
+		if inState && !remoteChanged && propagateDeletes {
+			return syncDeleteRemote
+		}
+		return syncDownload
+	case !localChanged && !remoteChanged:
+		return syncNone
+	case localChanged && !remoteChanged:
+		return syncUpload
+	case !localChanged && remoteChanged:
+		return syncDownload
+	}
+	// both sides have changed, or this is the first sync of the path.
+	if !inState && l.size == r.size {
+		if sum, err := fileCRC32C(filepath.Join(dir, rel)); err == nil && sum == r.crc32c {
+			return syncNone
+		}
+	}
+	switch conflict {
+	case "local":
+		return syncUpload
+	case "remote":
+		return syncDownload
+	case "skip":
+		return syncSkip
+	}
+	if l.modTime.After(r.updated) {
+		return syncUpload
+	}
+	return syncDownload
+}
+
+type syncer struct {
+	dir       string
+	bucket    *storage.BucketHandle
+	prefix    string
+	chunkSize int
+	names     nameMode
+
+	mu   sync.Mutex
+	next map[string]syncStateEntry
+}
+
+func (s *syncer) record(rel string, l syncLocal, generation int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next[rel] = syncStateEntry{ModTime: l.modTime.UnixNano(), Size: l.size, Generation: generation}
+}
+
+// keep records the state of the previous sync for rel, if any, for a path
+// left unchanged.
+func (s *syncer) keep(rel string, prev syncStateEntry, inState bool) {
+	if !inState {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next[rel] = prev
+}
+
+func (s *syncer) apply(ctx context.Context, action syncAction, rel string, r syncRemote, hasRemote bool) error {
+	local := filepath.Join(s.dir, filepath.FromSlash(s.names.decode(rel)))
+	o := s.bucket.Object(s.prefix + rel)
+	switch action {
+	case syncUpload:
+		// the precondition makes a concurrent remote change fail instead of
+		// being overwritten silently.
+		cond := storage.Conditions{DoesNotExist: true}
+		if hasRemote {
+			cond = storage.Conditions{GenerationMatch: r.generation}
+		}
+		gen, err := s.upload(ctx, o.If(cond), local)
+		if err != nil {
+			return fmt.Errorf("upload(%s): %w", rel, err)
+		}
+		l, err := statSyncLocal(local)
+		if err != nil {
+			return err
+		}
+		s.record(rel, l, gen)
+	case syncDownload:
+		if err := s.download(ctx, o.Generation(r.generation), local, r.updated); err != nil {
+			return fmt.Errorf("download(%s): %w", rel, err)
+		}
+		l, err := statSyncLocal(local)
+		if err != nil {
+			return err
+		}
+		s.record(rel, l, r.generation)
+	case syncDeleteLocal:
+		if err := os.Remove(local); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("delete local(%s): %w", rel, err)
+		}
+	case syncDeleteRemote:
+		err := o.If(storage.Conditions{GenerationMatch: r.generation}).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("delete remote(%s): %w", rel, err)
+		}
+	}
+	return nil
+}
+
+func (s *syncer) upload(ctx context.Context, o *storage.ObjectHandle, name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := o.NewWriter(ctx)
+	w.ChunkSize = s.chunkSize
+	defer w.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return w.Attrs().Generation, nil
+}
+
+// download writes the object next to name and renames it into place so that
+// an interrupted download never leaves a truncated file behind.
+func (s *syncer) download(ctx context.Context, o *storage.ObjectHandle, name string, modTime time.Time) error {
+	r, err := o.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Dir(name), ".gcs-upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+	if _, err := io.Copy(tf, r); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tf.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), name)
+}
+
+// scanSyncLocal returns the regular files under dir by the object names
+// they are synchronized with.
+func scanSyncLocal(dir string, names nameMode) (map[string]syncLocal, error) {
+	m := map[string]syncLocal{}
+	err := fs.WalkDir(os.DirFS(dir), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(path.Base(p), ".gcs-upload-") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := names.encode(p)
+		if err != nil {
+			return err
+		}
+		m[name] = syncLocal{modTime: fi.ModTime(), size: fi.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk(%s): %w", dir, err)
+	}
+	return m, nil
+}
+
+func statSyncLocal(name string) (syncLocal, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return syncLocal{}, fmt.Errorf("stat: %w", err)
+	}
+	return syncLocal{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func scanSyncRemote(ctx context.Context, bucket *storage.BucketHandle, prefix string) (map[string]syncRemote, error) {
+	m := map[string]syncRemote{}
+	q := &storage.Query{Prefix: prefix, Projection: storage.ProjectionNoACL}
+	if err := q.SetAttrSelection([]string{"Name", "Generation", "Updated", "Size", "CRC32C"}); err != nil {
+		return nil, fmt.Errorf("set attr selection: %w", err)
+	}
+	it := bucket.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list(gs://%s/%s): %w", bucket.BucketName(), prefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+		m[strings.TrimPrefix(attrs.Name, prefix)] = syncRemote{
+			generation: attrs.Generation,
+			updated:    attrs.Updated,
+			size:       attrs.Size,
+			crc32c:     attrs.CRC32C,
+		}
+	}
+	return m, nil
+}
+
+func unionKeys(locals map[string]syncLocal, remotes map[string]syncRemote) []string {
+	keys := make([]string, 0, len(locals))
+	for k := range locals {
+		keys = append(keys, k)
+	}
+	for k := range remotes {
+		if _, ok := locals[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func fileCRC32C(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(castagnoliTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+func readSyncState(name string) (*syncState, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &syncState{Files: map[string]syncStateEntry{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	var st syncState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("parse state(%s): %w", name, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]syncStateEntry{}
+	}
+	return &st, nil
+}
+
+func writeSyncState(name string, st *syncState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return writeFileAtomic(name, b)
+}
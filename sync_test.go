@@ -0,0 +1,72 @@
+package main
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecideSync(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	t1 := t0.Add(time.Hour)
+	local := syncLocal{modTime: t0, size: 10}
+	changedLocal := syncLocal{modTime: t1, size: 11}
+	remote := syncRemote{generation: 1, updated: t0, size: 10}
+	changedRemote := syncRemote{generation: 2, updated: t1, size: 12}
+	prev := syncStateEntry{ModTime: t0.UnixNano(), Size: 10, Generation: 1}
+
+	tests := []struct {
+		name             string
+		l                syncLocal
+		hasLocal         bool
+		r                syncRemote
+		hasRemote        bool
+		inState          bool
+		conflict         string
+		propagateDeletes bool
+		want             syncAction
+	}{
+		{name: "unchanged", l: local, hasLocal: true, r: remote, hasRemote: true, inState: true, want: syncNone},
+		{name: "local changed", l: changedLocal, hasLocal: true, r: remote, hasRemote: true, inState: true, want: syncUpload},
+		{name: "remote changed", l: local, hasLocal: true, r: changedRemote, hasRemote: true, inState: true, want: syncDownload},
+		{name: "new local", l: local, hasLocal: true, want: syncUpload},
+		{name: "new remote", r: remote, hasRemote: true, want: syncDownload},
+		{name: "remote deleted", l: local, hasLocal: true, inState: true, propagateDeletes: true, want: syncDeleteLocal},
+		{name: "remote deleted without propagation", l: local, hasLocal: true, inState: true, want: syncUpload},
+		{name: "remote deleted after local change", l: changedLocal, hasLocal: true, inState: true, propagateDeletes: true, want: syncUpload},
+		{name: "local deleted", r: remote, hasRemote: true, inState: true, propagateDeletes: true, want: syncDeleteRemote},
+		{name: "local deleted after remote change", r: changedRemote, hasRemote: true, inState: true, propagateDeletes: true, want: syncDownload},
+		{name: "conflict newer local", l: syncLocal{modTime: t1.Add(time.Hour), size: 11}, hasLocal: true, r: changedRemote, hasRemote: true, inState: true, want: syncUpload},
+		{name: "conflict newer remote", l: changedLocal, hasLocal: true, r: syncRemote{generation: 2, updated: t1.Add(time.Hour)}, hasRemote: true, inState: true, want: syncDownload},
+		{name: "conflict local", l: changedLocal, hasLocal: true, r: changedRemote, hasRemote: true, inState: true, conflict: "local", want: syncUpload},
+		{name: "conflict remote", l: changedLocal, hasLocal: true, r: changedRemote, hasRemote: true, inState: true, conflict: "remote", want: syncDownload},
+		{name: "conflict skip", l: changedLocal, hasLocal: true, r: changedRemote, hasRemote: true, inState: true, conflict: "skip", want: syncSkip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decideSync(t.TempDir(), "f", tt.l, tt.hasLocal, tt.r, tt.hasRemote, prev, tt.inState, tt.conflict, tt.propagateDeletes)
+			if got != tt.want {
+				t.Errorf("decideSync = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecideSyncFirstSyncSameContent(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("same content")
+	if err := os.WriteFile(filepath.Join(dir, "f"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := syncLocal{modTime: time.Unix(1, 0), size: int64(len(content))}
+	r := syncRemote{generation: 1, updated: time.Unix(2, 0), size: int64(len(content)), crc32c: crc32.Checksum(content, castagnoliTable)}
+	if got := decideSync(dir, "f", l, true, r, true, syncStateEntry{}, false, "", false); got != syncNone {
+		t.Errorf("decideSync = %v, want %v", got, syncNone)
+	}
+	r.crc32c++
+	if got := decideSync(dir, "f", l, true, r, true, syncStateEntry{}, false, "", false); got != syncDownload {
+		t.Errorf("decideSync of different content = %v, want %v", got, syncDownload)
+	}
+}
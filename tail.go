@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// tailState records how much of every file has been shipped, by the key of
+// tailKey, so that a rotated file renamed in the directory continues at its
+// offset while the new file at its path starts from the beginning.
+type tailState struct {
+	Files map[string]tailFile `json:"files"`
+	// Offsets are the offsets by path of the state files of earlier
+	// versions, taken over by the first walk.
+	Offsets map[string]int64 `json:"offsets,omitempty"`
+}
+
+type tailFile struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// tailKey returns the key of the file p of fi in the state: its device and
+// inode, or its path where files have none.
+func tailKey(p string, fi fs.FileInfo) string {
+	if dev, ino, _, ok := fileInode(fi); ok {
+		return fmt.Sprintf("%d:%d", dev, ino)
+	}
+	return p
+}
+
+func runTail(args []string) error {
+	cmd := flag.NewFlagSet("tail", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage of gcs-upload tail -d <dir> -state <file> <dest>:\n")
+		cmd.PrintDefaults()
+	}
+	verbose := cmd.Bool("v", false, "show verbose output")
+	dir := cmd.String("d", "", "local directory containing the append-only files")
+	statePath := cmd.String("state", "", "state file recording the shipped offset of every file")
+	interval := cmd.Duration("interval", time.Minute, "interval between uploads of new content")
+	chunkSize := flagBytesSet(cmd, "chunk", 16*1024*1024, "upload chunk size")
+	cmd.Parse(args)
+
+	if cmd.NArg() != 1 || *dir == "" || *statePath == "" {
+		cmd.Usage()
+		return fmt.Errorf("invalid args")
+	}
+	dest, err := url.ParseRequestURI(cmd.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse dest: %w", err)
+	}
+	if dest.Scheme != "gs" || dest.Host == "" {
+		return fmt.Errorf("dest must be gs://bucket or gs://bucket/prefix: %s", dest)
+	}
+
+	st, err := readTailState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	gcs, err := newStorageClient(ctx, clientConfig{})
+	if err != nil {
+		return fmt.Errorf("storage client: %w", err)
+	}
+	bucket := gcs.Bucket(dest.Hostname())
+	prefix := objectPrefix(dest)
+
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for {
+		seen := map[string]bool{}
+		err := fs.WalkDir(os.DirFS(*dir), ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			key, name, err := shipTail(ctx, bucket, prefix, *dir, p, st, int(*chunkSize))
+			if key != "" {
+				seen[key] = true
+			}
+			if err != nil {
+				return fmt.Errorf("ship(%s): %w", p, err)
+			}
+			if name == "" {
+				return nil
+			}
+			if *verbose {
+				log.Printf("%s: -> gs://%s/%s", p, bucket.BucketName(), name)
+			}
+			// saved after every object, so that a restart ships again at
+			// most the bytes of the object being uploaded. Delivery is
+			// at-least-once: a crash after the object is finalized but
+			// before the state is saved ships its bytes again, in an
+			// object of another name.
+			return writeTailState(*statePath, st)
+		})
+		if err == nil {
+			// the inode of a removed file can be reused by a new one, which
+			// must not start at the offset of the removed file.
+			for k := range st.Files {
+				if !seen[k] {
+					delete(st.Files, k)
+				}
+			}
+			st.Offsets = nil
+			err = writeTailState(*statePath, st)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("tail: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// shipTail uploads the content of the file p appended after its offset in
+// st as a new object named after the time and the offset, and records the
+// new offset in st. It returns the key of the file in st and the name of the
+// object, or "" if nothing was appended. A file that became smaller than its
+// offset has been truncated and is shipped from the start.
+func shipTail(ctx context.Context, bucket *storage.BucketHandle, prefix, dir, p string, st *tailState, chunkSize int) (string, string, error) {
+	f, err := os.Open(filepath.Join(dir, p))
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	key := tailKey(p, fi)
+	e, ok := st.Files[key]
+	if !ok {
+		e.Offset = st.Offsets[p]
+	}
+	e.Path = p
+	if fi.Size() < e.Offset {
+		e.Offset = 0
+	}
+	st.Files[key] = e
+	n := fi.Size() - e.Offset
+	if n == 0 {
+		return key, "", nil
+	}
+	if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+		return key, "", err
+	}
+	name := path.Join(prefix, p) + fmt.Sprintf(".%s.%d", time.Now().UTC().Format("20060102T150405Z"), e.Offset)
+	w := bucket.Object(name).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ChunkSize = chunkSize
+	defer w.Close()
+	if _, err := io.Copy(w, io.LimitReader(f, n)); err != nil {
+		return key, "", err
+	}
+	if err := w.Close(); err != nil {
+		return key, "", err
+	}
+	st.Files[key] = tailFile{Path: p, Offset: e.Offset + n}
+	return key, name, nil
+}
+
+func readTailState(name string) (*tailState, error) {
+	st := &tailState{Files: map[string]tailFile{}}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("parse state(%s): %w", name, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]tailFile{}
+	}
+	return st, nil
+}
+
+func writeTailState(name string, st *tailState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return writeFileAtomic(name, b)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestTailRenamedFileKeepsOffset(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("files have no inode")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.log"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := tailKey("a.log", fi)
+	st := &tailState{Files: map[string]tailFile{key: {Path: "a.log", Offset: 5}}}
+	if err := os.Rename(filepath.Join(dir, "a.log"), filepath.Join(dir, "a.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is left to ship, so no bucket is needed.
+	got, name, err := shipTail(context.Background(), nil, "", dir, "a.log.1", st, 0)
+	if err != nil || name != "" {
+		t.Fatalf("shipTail(a.log.1) = %q, %v, want nothing shipped", name, err)
+	}
+	if got != key || st.Files[key] != (tailFile{Path: "a.log.1", Offset: 5}) {
+		t.Errorf("state = %q: %+v, want %q: {a.log.1 5}", got, st.Files[got], key)
+	}
+}
@@ -0,0 +1,41 @@
+// Command wasmplugin is a -plugin-wasm for the tests, built with
+// GOOS=wasip1 GOARCH=wasm. It skips the sources ending in ".tmp", moves the
+// objects below "renamed/", stamps the size as metadata, and spins forever
+// for the source "hang".
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	for s.Scan() {
+		var req struct {
+			Source string `json:"source"`
+			Object string `json:"object"`
+			Size   int64  `json:"size"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			enc.Encode(map[string]string{"error": err.Error()})
+			continue
+		}
+		switch {
+		case req.Source == "hang":
+			for {
+			}
+		case strings.HasSuffix(req.Source, ".tmp"):
+			enc.Encode(map[string]bool{"skip": true})
+		default:
+			enc.Encode(map[string]any{
+				"object":   "renamed/" + req.Object,
+				"metadata": map[string]string{"size": fmt.Sprint(req.Size)},
+			})
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceEvent is one line of a -record trace. Offsets are relative to the
+// start of the run.
+type traceEvent struct {
+	// Kind is "run", "file", "done" or "http".
+	Kind string        `json:"kind"`
+	At   time.Duration `json:"at"`
+	// Args of the recorded run, in the "run" event.
+	Args []string `json:"args,omitempty"`
+	// Source of the "file" and "done" events.
+	Source string `json:"source,omitempty"`
+	// Method, URL and the response of the "http" events.
+	Method  string        `json:"method,omitempty"`
+	URL     string        `json:"url,omitempty"`
+	Status  int           `json:"status,omitempty"`
+	Header  http.Header   `json:"header,omitempty"`
+	Body    []byte        `json:"body,omitempty"`
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+	// Error of a failed file or request.
+	Error string `json:"error,omitempty"`
+}
+
+// trace records the order and timing in which files are started, their
+// outcomes and every storage request of a run, or replays a recorded one:
+// the files start no earlier than they did and every request receives its
+// recorded response after its recorded latency, without any network access,
+// so that an intermittent failure can be reproduced offline.
+type trace struct {
+	start time.Time
+
+	// record
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+
+	// replay
+	files     map[string][]time.Duration
+	responses map[string][]*traceEvent
+}
+
+// recordTrace creates the trace file name and records the arguments of the
+// run in it, without their secrets.
+func recordTrace(name string) (*trace, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("create trace: %w", err)
+	}
+	t := &trace{start: time.Now(), f: f, enc: json.NewEncoder(f)}
+	t.write(&traceEvent{Kind: "run", Args: redactArgs(os.Args[1:])})
+	return t, nil
+}
+
+// secretFlags are the flags whose values are replaced in a trace, and
+// urlFlags the ones whose URLs lose their password.
+var (
+	secretFlags = map[string]bool{"encryption-key": true, "decryption-keys": true}
+	urlFlags    = map[string]bool{"proxy": true, "endpoint": true}
+)
+
+// redactArgs returns the command line args with the values of secretFlags
+// and the passwords of urlFlags redacted, in both the "-flag value" and the
+// "-flag=value" forms. Like the flag package it stops at "--" or the first
+// argument that is not a flag.
+func redactArgs(args []string) []string {
+	args = slices.Clone(args)
+	redact := func(name, v string) string {
+		switch {
+		case secretFlags[name]:
+			return "REDACTED"
+		case urlFlags[name]:
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				return u.Redacted()
+			}
+		}
+		return v
+	}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		if name, v, ok := strings.Cut(name, "="); ok {
+			args[i] = a[:len(a)-len(v)] + redact(name, v)
+			continue
+		}
+		if (secretFlags[name] || urlFlags[name]) && i+1 < len(args) {
+			i++
+			args[i] = redact(name, args[i])
+		}
+	}
+	return args
+}
+
+// replayTrace loads the trace file name for replaying.
+func replayTrace(name string) (*trace, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open trace: %w", err)
+	}
+	defer f.Close()
+	t := &trace{files: map[string][]time.Duration{}, responses: map[string][]*traceEvent{}}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var ev traceEvent
+		if err := dec.Decode(&ev); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read trace: %w", err)
+		}
+		switch ev.Kind {
+		case "file":
+			t.files[ev.Source] = append(t.files[ev.Source], ev.At)
+		case "http":
+			key := ev.Method + " " + ev.URL
+			t.responses[key] = append(t.responses[key], &ev)
+		}
+	}
+	t.start = time.Now()
+	return t, nil
+}
+
+func (t *trace) write(ev *traceEvent) {
+	ev.At = time.Since(t.start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a trace is best effort and must not fail the run.
+	_ = t.enc.Encode(ev)
+}
+
+// fileStarted records the start of the upload of f, or waits until its
+// recorded start when replaying.
+func (t *trace) fileStarted(ctx context.Context, f string) error {
+	switch {
+	case t == nil:
+		return nil
+	case t.enc != nil:
+		t.write(&traceEvent{Kind: "file", Source: f})
+		return nil
+	}
+	t.mu.Lock()
+	var at time.Duration
+	if q := t.files[f]; len(q) > 0 {
+		at, t.files[f] = q[0], q[1:]
+	}
+	t.mu.Unlock()
+	return sleepCtx(ctx, time.Until(t.start.Add(at)))
+}
+
+// fileDone records the outcome of the upload of f.
+func (t *trace) fileDone(f string, err error) {
+	if t == nil || t.enc == nil {
+		return
+	}
+	ev := &traceEvent{Kind: "done", Source: f}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	t.write(ev)
+}
+
+// transport returns the transport recording or replaying the requests sent
+// through base.
+func (t *trace) transport(base http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return base
+	}
+	return &traceTransport{trace: t, base: base}
+}
+
+// Close closes the trace file.
+func (t *trace) Close() error {
+	if t == nil || t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+type traceTransport struct {
+	trace *trace
+	base  http.RoundTripper
+}
+
+func (tt *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tt.trace.enc == nil {
+		return tt.replay(req)
+	}
+	start := time.Now()
+	resp, err := tt.base.RoundTrip(req)
+	ev := &traceEvent{Kind: "http", Method: req.Method, URL: req.URL.String()}
+	if err != nil {
+		ev.Elapsed = time.Since(start)
+		ev.Error = err.Error()
+		tt.trace.write(ev)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ev.Elapsed = time.Since(start)
+	ev.Status = resp.StatusCode
+	ev.Header = resp.Header
+	ev.Body = body
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	tt.trace.write(ev)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (tt *traceTransport) replay(req *http.Request) (*http.Response, error) {
+	// the request body is consumed as the server would, so that the writer
+	// feeding it does not block.
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	key := req.Method + " " + req.URL.String()
+	t := tt.trace
+	t.mu.Lock()
+	var ev *traceEvent
+	if q := t.responses[key]; len(q) > 0 {
+		ev, t.responses[key] = q[0], q[1:]
+	}
+	t.mu.Unlock()
+	if ev == nil {
+		return nil, fmt.Errorf("replay: no recorded response for %s", key)
+	}
+	if err := sleepCtx(req.Context(), ev.Elapsed); err != nil {
+		return nil, err
+	}
+	if ev.Status == 0 {
+		return nil, replayedError(ev.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ev.Status, http.StatusText(ev.Status)),
+		StatusCode:    ev.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ev.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(ev.Body)),
+		ContentLength: int64(len(ev.Body)),
+		Request:       req,
+	}, nil
+}
+
+// replayedError is a recorded transport failure. It is temporary so that
+// the client retries it as it would most real ones.
+type replayedError string
+
+func (e replayedError) Error() string   { return "replay: " + string(e) }
+func (e replayedError) Temporary() bool { return true }
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// uploadClient uploads objects with the JSON API from chunk buffers that are
+// reused across objects. The storage writer allocates a buffer of its chunk
+// size for every object, which dominates the allocations of a run and is
+// only collected by the next GC.
+type uploadClient struct {
+	*xmlClient
+	chunks chunkPool
+}
+
+// chunkPool holds the chunk buffers of the uploads by their size.
+type chunkPool struct {
+	pools sync.Map
+}
+
+func (p *chunkPool) get(size int) *[]byte {
+	v, ok := p.pools.Load(size)
+	if !ok {
+		v, _ = p.pools.LoadOrStore(size, &sync.Pool{New: func() any {
+			b := make([]byte, size)
+			return &b
+		}})
+	}
+	return v.(*sync.Pool).Get().(*[]byte)
+}
+
+func (p *chunkPool) put(b *[]byte) {
+	if v, ok := p.pools.Load(len(*b)); ok {
+		v.(*sync.Pool).Put(b)
+	}
+}
+
+// objectWriter writes an object like storage.Writer, whose fields it has.
+// Objects that fit in a chunk are uploaded in a single request and larger
+// ones with a resumable upload, both from a buffer of the pool of the
+// client. Without a client, i.e. over gRPC, and with a ChunkSize of 0, which
+// needs no buffer, it writes through a storage.Writer.
+type objectWriter struct {
+	storage.ObjectAttrs
+	ChunkSize             int
+	ChunkRetryDeadline    time.Duration
+	SendCRC32C            bool
+	ForceEmptyContentType bool
+
+	ctx context.Context
+	c   *uploadClient
+	// o carries the preconditions conds and the customer-supplied key for
+	// the storage writer, which the requests of c cannot read from it.
+	o     *storage.ObjectHandle
+	conds storage.Conditions
+	key   []byte
+
+	w       *storage.Writer
+	buf     *[]byte
+	n       int
+	offset  int64
+	session string
+	attrs   *storage.ObjectAttrs
+	err     error
+	closed  bool
+}
+
+// NewWriter returns a writer of the object o with the preconditions conds
+// and the customer-supplied key key, which o must carry as well. The object
+// is only finalized by Close, and never once ctx is canceled.
+func (c *uploadClient) NewWriter(ctx context.Context, o *storage.ObjectHandle, conds storage.Conditions, key []byte) *objectWriter {
+	return &objectWriter{
+		ObjectAttrs: storage.ObjectAttrs{Bucket: o.BucketName(), Name: o.ObjectName()},
+		ctx:         ctx,
+		c:           c,
+		o:           o,
+		conds:       conds,
+		key:         key,
+	}
+}
+
+// pooled reports whether the object is uploaded from a pooled buffer.
+func (w *objectWriter) pooled() bool {
+	return w.c != nil && w.ChunkSize > 0
+}
+
+func (w *objectWriter) storageWriter() *storage.Writer {
+	sw := w.o.NewWriter(w.ctx)
+	sw.ObjectAttrs = w.ObjectAttrs
+	sw.ChunkSize = w.ChunkSize
+	sw.ChunkRetryDeadline = w.ChunkRetryDeadline
+	sw.SendCRC32C = w.SendCRC32C
+	sw.ForceEmptyContentType = w.ForceEmptyContentType
+	return sw
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.pooled() {
+		if w.w == nil {
+			w.w = w.storageWriter()
+		}
+		n, err := w.w.Write(p)
+		if err != nil {
+			w.err = err
+		}
+		return n, err
+	}
+	if w.buf == nil {
+		// the chunks but the last are multiples of the minimal chunk
+		// size, as with the storage writer.
+		size := (w.ChunkSize + googleapi.MinUploadChunkSize - 1) / googleapi.MinUploadChunkSize * googleapi.MinUploadChunkSize
+		w.buf = w.c.chunks.get(size)
+	}
+	var n int
+	for len(p) > 0 {
+		// a full buffer is only sent once more follows, so that an object
+		// of a chunk is uploaded in a single request.
+		if w.n == len(*w.buf) {
+			if err := w.flush(); err != nil {
+				w.err = err
+				return n, err
+			}
+		}
+		m := copy((*w.buf)[w.n:], p)
+		w.n += m
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close finalizes the object and returns the buffer to the pool. Nothing is
+// finalized once the context is canceled or a write has failed.
+func (w *objectWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if !w.pooled() {
+		if w.w == nil {
+			// the storage writer would create an empty object.
+			if err := w.ctx.Err(); err != nil {
+				w.err = err
+				return err
+			}
+			w.w = w.storageWriter()
+		}
+		if err := w.w.Close(); err != nil {
+			w.err = err
+			return err
+		}
+		w.attrs = w.w.Attrs()
+		return nil
+	}
+	defer w.release()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.err = err
+		return err
+	}
+	if w.session == "" {
+		w.err = w.upload()
+	} else {
+		w.err = w.send(true)
+	}
+	return w.err
+}
+
+func (w *objectWriter) release() {
+	if w.buf != nil {
+		w.c.chunks.put(w.buf)
+		w.buf = nil
+	}
+}
+
+// Attrs returns the attributes of the object once Close has succeeded.
+func (w *objectWriter) Attrs() *storage.ObjectAttrs {
+	return w.attrs
+}
+
+// data returns the bytes of the buffer.
+func (w *objectWriter) data() []byte {
+	if w.buf == nil {
+		return nil
+	}
+	return (*w.buf)[:w.n]
+}
+
+// flush sends the full buffer as a chunk of the resumable upload, which it
+// starts with the first one.
+func (w *objectWriter) flush() error {
+	if w.session == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	return w.send(false)
+}
+
+// uploadURL returns the URL of the upload of the object of uploadType.
+func (w *objectWriter) uploadURL(uploadType string) string {
+	q := url.Values{"uploadType": {uploadType}, "name": {w.Name}}
+	switch {
+	case w.conds.DoesNotExist:
+		q.Set("ifGenerationMatch", "0")
+	case w.conds.GenerationMatch != 0:
+		q.Set("ifGenerationMatch", strconv.FormatInt(w.conds.GenerationMatch, 10))
+	case w.conds.GenerationNotMatch != 0:
+		q.Set("ifGenerationNotMatch", strconv.FormatInt(w.conds.GenerationNotMatch, 10))
+	}
+	if w.conds.MetagenerationMatch != 0 {
+		q.Set("ifMetagenerationMatch", strconv.FormatInt(w.conds.MetagenerationMatch, 10))
+	}
+	if w.conds.MetagenerationNotMatch != 0 {
+		q.Set("ifMetagenerationNotMatch", strconv.FormatInt(w.conds.MetagenerationNotMatch, 10))
+	}
+	if w.PredefinedACL != "" {
+		q.Set("predefinedAcl", w.PredefinedACL)
+	}
+	if w.KMSKeyName != "" {
+		q.Set("kmsKeyName", w.KMSKeyName)
+	}
+	if w.c.userProject != "" {
+		q.Set("userProject", w.c.userProject)
+	}
+	return w.c.endpoint + "/upload/storage/v1/b/" + url.PathEscape(w.Bucket) + "/o?" + q.Encode()
+}
+
+// resource returns the JSON resource of the new object. An empty content
+// type is sniffed from the first bytes of the content unless it is forced
+// empty, as the storage writer does.
+func (w *objectWriter) resource() ([]byte, error) {
+	o := rawObject(&w.ObjectAttrs)
+	if o.ContentType == "" && !w.ForceEmptyContentType {
+		data := w.data()
+		o.ContentType = http.DetectContentType(data[:min(len(data), 512)])
+	}
+	if w.SendCRC32C {
+		o.Crc32c = encodeUint32(w.CRC32C)
+	}
+	if len(w.MD5) > 0 {
+		o.Md5Hash = base64.StdEncoding.EncodeToString(w.MD5)
+	}
+	return json.Marshal(o)
+}
+
+// upload uploads the object held by the buffer in a single multipart
+// request.
+func (w *objectWriter) upload() error {
+	meta, err := w.resource()
+	if err != nil {
+		return err
+	}
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	head := "--" + boundary + "\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n" + string(meta) +
+		"\r\n--" + boundary + "\r\nContent-Type: application/octet-stream\r\n\r\n"
+	tail := "\r\n--" + boundary + "--\r\n"
+	data := w.data()
+	return w.retry(func() error {
+		body := io.MultiReader(strings.NewReader(head), bytes.NewReader(data), strings.NewReader(tail))
+		req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.uploadURL("multipart"), body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(head) + len(data) + len(tail))
+		req.Header.Set("Content-Type", "multipart/related; boundary="+boundary)
+		setKeyHeader(req.Header, w.key)
+		resp, err := w.c.hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		return w.decode(resp)
+	})
+}
+
+// start starts the resumable upload of the object.
+func (w *objectWriter) start() error {
+	meta, err := w.resource()
+	if err != nil {
+		return err
+	}
+	return w.retry(func() error {
+		req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.uploadURL("resumable"), bytes.NewReader(meta))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		setKeyHeader(req.Header, w.key)
+		resp, err := w.c.hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		w.session = resp.Header.Get("Location")
+		if w.session == "" {
+			return errors.New("start upload: no session URI in the response")
+		}
+		return nil
+	})
+}
+
+// send sends the buffer as the chunk at its offset in the object, the last
+// one if final. After a failure, it is sent again from the offset the
+// service reported as persisted.
+func (w *objectWriter) send(final bool) error {
+	data := w.data()
+	end := w.offset + int64(len(data))
+	total := "*"
+	if final {
+		total = strconv.FormatInt(end, 10)
+	}
+	persisted := w.offset
+	err := w.retry(func() error {
+		for {
+			req, err := http.NewRequestWithContext(w.ctx, http.MethodPut, w.session, bytes.NewReader(data[persisted-w.offset:]))
+			if err != nil {
+				return err
+			}
+			if persisted < end {
+				req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", persisted, end-1, total))
+			} else {
+				// all is persisted; this finalizes the object.
+				req.Header.Set("Content-Range", "bytes */"+total)
+			}
+			setKeyHeader(req.Header, w.key)
+			resp, err := w.c.hc.Do(req)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusPermanentRedirect {
+				defer resp.Body.Close()
+				if err := googleapi.CheckResponse(resp); err != nil {
+					return err
+				}
+				if !final {
+					return fmt.Errorf("upload chunk: finalized at %d bytes", end)
+				}
+				return w.decode(resp)
+			}
+			resp.Body.Close()
+			n, err := parsePersisted(resp.Header.Get("Range"))
+			if err != nil {
+				return err
+			}
+			if n < w.offset || n > end || n <= persisted && persisted < end {
+				return fmt.Errorf("upload chunk: %d bytes persisted after sending up to %d", n, end)
+			}
+			persisted = n
+			if !final && persisted == end {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	w.offset = end
+	w.n = 0
+	return nil
+}
+
+// parsePersisted returns the number of bytes a response of a resumable upload
+// reports as persisted in its Range header, "bytes=0-<last>".
+func parsePersisted(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	_, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, fmt.Errorf("upload chunk: invalid range %q", s)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("upload chunk: invalid range %q", s)
+	}
+	return n + 1, nil
+}
+
+// retry calls fn until it succeeds or fails with an error that is not
+// retried, for at most ChunkRetryDeadline and the attempts of the client, as
+// the storage writer retries a chunk.
+func (w *objectWriter) retry(fn func() error) error {
+	bo := w.c.backoff
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !storage.ShouldRetry(err) || w.ctx.Err() != nil ||
+			(w.c.maxAttempts > 0 && attempt >= w.c.maxAttempts) ||
+			(w.ChunkRetryDeadline > 0 && time.Since(start) >= w.ChunkRetryDeadline) {
+			return err
+		}
+		if err := gax.Sleep(w.ctx, bo.Pause()); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *objectWriter) decode(resp *http.Response) error {
+	var o raw.Object
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return fmt.Errorf("decode object: %w", err)
+	}
+	w.attrs = newObjectAttrs(&o)
+	return nil
+}
+
+// rawObject returns the JSON resource of the attributes a new object is
+// written with.
+func rawObject(a *storage.ObjectAttrs) *raw.Object {
+	o := &raw.Object{
+		Name:               a.Name,
+		ContentType:        a.ContentType,
+		ContentEncoding:    a.ContentEncoding,
+		ContentDisposition: a.ContentDisposition,
+		ContentLanguage:    a.ContentLanguage,
+		CacheControl:       a.CacheControl,
+		Metadata:           a.Metadata,
+		StorageClass:       a.StorageClass,
+		EventBasedHold:     a.EventBasedHold,
+		TemporaryHold:      a.TemporaryHold,
+	}
+	if !a.CustomTime.IsZero() {
+		o.CustomTime = a.CustomTime.Format(time.RFC3339Nano)
+	}
+	if a.Retention != nil {
+		o.Retention = &raw.ObjectRetention{Mode: a.Retention.Mode, RetainUntilTime: a.Retention.RetainUntil.Format(time.RFC3339Nano)}
+	}
+	for _, r := range a.ACL {
+		o.Acl = append(o.Acl, &raw.ObjectAccessControl{Entity: string(r.Entity), Role: string(r.Role)})
+	}
+	return o
+}
+
+// newObjectAttrs returns the attributes of the JSON resource o.
+func newObjectAttrs(o *raw.Object) *storage.ObjectAttrs {
+	a := &storage.ObjectAttrs{
+		Bucket:                  o.Bucket,
+		Name:                    o.Name,
+		ContentType:             o.ContentType,
+		ContentEncoding:         o.ContentEncoding,
+		ContentDisposition:      o.ContentDisposition,
+		ContentLanguage:         o.ContentLanguage,
+		CacheControl:            o.CacheControl,
+		EventBasedHold:          o.EventBasedHold,
+		TemporaryHold:           o.TemporaryHold,
+		RetentionExpirationTime: parseRFC3339(o.RetentionExpirationTime),
+		Size:                    int64(o.Size),
+		MediaLink:               o.MediaLink,
+		Metadata:                o.Metadata,
+		Generation:              o.Generation,
+		Metageneration:          o.Metageneration,
+		StorageClass:            o.StorageClass,
+		Created:                 parseRFC3339(o.TimeCreated),
+		Updated:                 parseRFC3339(o.Updated),
+		CustomTime:              parseRFC3339(o.CustomTime),
+		KMSKeyName:              o.KmsKeyName,
+		Etag:                    o.Etag,
+		ComponentCount:          o.ComponentCount,
+	}
+	a.MD5, _ = base64.StdEncoding.DecodeString(o.Md5Hash)
+	if b, err := base64.StdEncoding.DecodeString(o.Crc32c); err == nil && len(b) == 4 {
+		a.CRC32C = binary.BigEndian.Uint32(b)
+	}
+	if o.CustomerEncryption != nil {
+		a.CustomerKeySHA256 = o.CustomerEncryption.KeySha256
+	}
+	if o.Owner != nil {
+		a.Owner = o.Owner.Entity
+	}
+	if o.Retention != nil {
+		a.Retention = &storage.ObjectRetention{Mode: o.Retention.Mode, RetainUntil: parseRFC3339(o.Retention.RetainUntilTime)}
+	}
+	for _, r := range o.Acl {
+		a.ACL = append(a.ACL, storage.ACLRule{Entity: storage.ACLEntity(r.Entity), Role: storage.ACLRole(r.Role)})
+	}
+	return a
+}
+
+func parseRFC3339(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+func encodeUint32(u uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, u))
+}
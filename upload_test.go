@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// fakeUploads serves the uploads of the JSON API for the object bkt/obj.
+type fakeUploads struct {
+	t        *testing.T
+	requests int
+	// fail fails the chunk requests of these numbers with a 503, and
+	// partial persists only the first half of theirs.
+	fail, partial map[int]bool
+	query         string
+	resource      string
+	content       []byte
+}
+
+func (f *fakeUploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	object := func() {
+		fmt.Fprintf(w, `{"bucket":"bkt","name":"obj","generation":"7","size":"%d"}`, len(f.content))
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bkt/o":
+		f.query = r.URL.RawQuery
+		if r.URL.Query().Get("uploadType") == "resumable" {
+			b, _ := io.ReadAll(r.Body)
+			f.resource = string(b)
+			w.Header().Set("Location", "http://"+r.Host+"/session")
+			return
+		}
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for i := 0; ; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := io.ReadAll(p)
+			if i == 0 {
+				f.resource = string(b)
+			} else {
+				f.content = b
+			}
+		}
+		object()
+	case r.Method == http.MethodPut && r.URL.Path == "/session":
+		body, _ := io.ReadAll(r.Body)
+		if f.fail[f.requests] {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rng, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+		if first, _, ok := strings.Cut(rng, "-"); ok {
+			start, _ := strconv.Atoi(first)
+			if start > len(f.content) {
+				f.t.Errorf("chunk at %d after %d persisted bytes", start, len(f.content))
+			}
+			if f.partial[f.requests] {
+				body = body[:len(body)/2]
+			}
+			// resent bytes are ignored.
+			if end := start + len(body); end > len(f.content) {
+				f.content = append(f.content, body[len(f.content)-start:]...)
+			}
+		}
+		if total != "*" && total == strconv.Itoa(len(f.content)) {
+			object()
+			return
+		}
+		if len(f.content) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(f.content)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newTestUploads(t *testing.T, f *fakeUploads) (*uploadClient, *storage.ObjectHandle) {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	gcs, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication(), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gcs.Close() })
+	c := &uploadClient{xmlClient: &xmlClient{hc: srv.Client(), endpoint: srv.URL, backoff: gax.Backoff{Initial: time.Millisecond}}}
+	return c, gcs.Bucket("bkt").Object("obj")
+}
+
+func TestObjectWriterSingleRequest(t *testing.T) {
+	f := &fakeUploads{t: t}
+	c, o := newTestUploads(t, f)
+	conds := storage.Conditions{DoesNotExist: true}
+	w := c.NewWriter(context.Background(), o.If(conds), conds, nil)
+	w.ChunkSize = googleapi.MinUploadChunkSize
+	w.Metadata = map[string]string{"k": "v"}
+	if _, err := io.WriteString(w, "hello, world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if f.requests != 1 {
+		t.Errorf("%d requests, want 1", f.requests)
+	}
+	if !strings.Contains(f.query, "uploadType=multipart") || !strings.Contains(f.query, "ifGenerationMatch=0") {
+		t.Errorf("query = %s, want a multipart upload with ifGenerationMatch=0", f.query)
+	}
+	if !strings.Contains(f.resource, `"contentType":"text/plain; charset=utf-8"`) || !strings.Contains(f.resource, `"metadata":{"k":"v"}`) {
+		t.Errorf("resource = %s, want the sniffed type and the metadata", f.resource)
+	}
+	if string(f.content) != "hello, world" {
+		t.Errorf("content = %q", f.content)
+	}
+	if a := w.Attrs(); a == nil || a.Generation != 7 || a.Size != 12 {
+		t.Errorf("Attrs = %+v, want generation 7 and size 12", a)
+	}
+}
+
+func TestObjectWriterResumable(t *testing.T) {
+	// request 1 starts the upload, 2 fails, 3 persists half of the first
+	// chunk.
+	f := &fakeUploads{t: t, fail: map[int]bool{2: true}, partial: map[int]bool{3: true}}
+	c, o := newTestUploads(t, f)
+	content := make([]byte, 2*googleapi.MinUploadChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	for i := range 2 {
+		f.requests, f.content = 0, nil
+		w := c.NewWriter(context.Background(), o, storage.Conditions{}, nil)
+		w.ChunkSize = googleapi.MinUploadChunkSize
+		w.ChunkRetryDeadline = time.Minute
+		if _, err := io.Copy(w, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if !bytes.Equal(f.content, content) {
+			t.Fatalf("upload %d: %d bytes uploaded differ from the %d written", i, len(f.content), len(content))
+		}
+		if a := w.Attrs(); a == nil || a.Size != int64(len(content)) {
+			t.Errorf("Attrs = %+v, want size %d", a, len(content))
+		}
+		// the second upload takes the buffer of the first from the pool.
+		f.fail, f.partial = nil, nil
+	}
+}
+
+func TestObjectWriterCanceled(t *testing.T) {
+	f := &fakeUploads{t: t}
+	c, o := newTestUploads(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := c.NewWriter(ctx, o, storage.Conditions{}, nil)
+	w.ChunkSize = googleapi.MinUploadChunkSize
+	if _, err := io.WriteString(w, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Error("Close = nil after the context was canceled")
+	}
+	if f.requests != 0 {
+		t.Errorf("%d requests after the context was canceled, want none", f.requests)
+	}
+}
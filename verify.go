@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksum is the size and CRC32C of the source content of an object.
+type checksum struct {
+	Size   int64
+	CRC32C uint32
+}
+
+// checkUploaded compares the attrs returned by a completed writer against
+// the checksums computed while streaming the object. md5sum is only compared
+// when it is not nil.
+func checkUploaded(attrs *storage.ObjectAttrs, sum checksum, md5sum []byte) error {
+	if attrs.Size != sum.Size || attrs.CRC32C != sum.CRC32C {
+		return fmt.Errorf("%w: size=%d crc32c=%08x, want size=%d crc32c=%08x", errChecksumMismatch, attrs.Size, attrs.CRC32C, sum.Size, sum.CRC32C)
+	}
+	if md5sum != nil && !bytes.Equal(attrs.MD5, md5sum) {
+		return fmt.Errorf("%w: md5=%x, want md5=%x", errChecksumMismatch, attrs.MD5, md5sum)
+	}
+	return nil
+}
+
+// sourceChecksums reads r to the end through stages, returns the CRC32C and
+// MD5 of the output and rewinds r for the upload. The stages must produce
+// the same output on every run.
+func sourceChecksums(r io.ReadSeeker, stages []writeStage, buf []byte) (uint32, []byte, error) {
+	c := crc32.New(castagnoliTable)
+	m := md5.New()
+	p := pipeline{stages: stages}
+	p.TapOutput(c)
+	p.TapOutput(m)
+	if _, err := p.Run(io.Discard, r, buf); err != nil {
+		return 0, nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	return c.Sum32(), m.Sum(nil), nil
+}
+
+type verifyEntry struct {
+	bucket string
+	name   string
+	sum    checksum
+}
+
+// verifyList collects the uploaded objects to be checked after the uploads.
+type verifyList struct {
+	mu      sync.Mutex
+	entries []verifyEntry
+}
+
+func (l *verifyList) Add(bucket, name string, sum checksum) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, verifyEntry{bucket: bucket, name: name, sum: sum})
+}
+
+// verifyObjects fetches the attributes of every object in parallel and
+// compares them against the checksums of the source content.
+func verifyObjects(ctx context.Context, bucket func(name string) *storage.BucketHandle, keys *encryptionKeys, l *verifyList, n int) (int64, error) {
+	var mismatched atomic.Int64
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(n)
+	for _, e := range l.entries {
+		eg.Go(func() error {
+			o := bucket(e.bucket).Object(e.name).Retryer(storage.WithPolicy(storage.RetryAlways))
+			attrs, err := keys.attrs(ctx, o)
+			if err != nil {
+				return fmt.Errorf("attrs(gs://%s/%s): %w", o.BucketName(), o.ObjectName(), err)
+			}
+			if attrs.Size != e.sum.Size || attrs.CRC32C != e.sum.CRC32C {
+				log.Printf("mismatch: gs://%s/%s: size=%d crc32c=%08x, want size=%d crc32c=%08x", o.BucketName(), o.ObjectName(), attrs.Size, attrs.CRC32C, e.sum.Size, e.sum.CRC32C)
+				mismatched.Add(1)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return mismatched.Load(), err
+	}
+	return mismatched.Load(), nil
+}
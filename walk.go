@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// walkOptions control which files of -d are uploaded.
+type walkOptions struct {
+	// Symlinks is how symbolic links are handled: follow uploads what they
+	// point to, descending into linked directories but skipping the links to
+	// a directory the walk is already in, skip leaves them out and error
+	// fails the walk.
+	Symlinks string
+	// Strict fails the walk on sockets, FIFOs and devices, which are
+	// otherwise skipped with a warning: reading a FIFO blocks until a writer
+	// shows up.
+	Strict bool
+	// MaxDepth is the number of directory levels descended into, counting
+	// dir itself, as the -maxdepth of find: 1 is only the files directly in
+	// dir. 0 means no limit.
+	MaxDepth int
+	// SkipHidden leaves out the files and directories whose names start
+	// with ".", except those whose paths match IncludeHidden.
+	SkipHidden    bool
+	IncludeHidden globList
+}
+
+// skips reports whether the walk leaves out the entry at the slash
+// separated path p below dir, a directory if isDir: hidden entries, and the
+// directories it does not descend into because of MaxDepth.
+func (o *walkOptions) skips(p string, isDir bool) bool {
+	if p == "." {
+		return false
+	}
+	if o.SkipHidden && strings.HasPrefix(path.Base(p), ".") && !o.IncludeHidden.Match(p) {
+		return true
+	}
+	return isDir && o.MaxDepth > 0 && walkDepth(p) >= o.MaxDepth
+}
+
+// walkFiles calls fn with the slash separated path of every file below dir.
+func walkFiles(dir string, opts walkOptions, fn func(p string) error) error {
+	return walkTree(dir, ".", opts, fn, nil)
+}
+
+// walkTree walks the tree at the slash separated path root below dir,
+// calling fn with the files and dirFn, if not nil, with the directories it
+// descends into, root included.
+func walkTree(dir, root string, opts walkOptions, fn, dirFn func(p string) error) error {
+	return fs.WalkDir(os.DirFS(dir), root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if opts.skips(p, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			if d.IsDir() {
+				if dirFn != nil {
+					return dirFn(p)
+				}
+				return nil
+			}
+			return walkFile(p, d.Type(), opts, fn)
+		}
+		switch opts.Symlinks {
+		case "skip":
+			return nil
+		case "error":
+			return fmt.Errorf("%s: symbolic link", p)
+		}
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		fi, err := os.Stat(full)
+		if err != nil {
+			return fmt.Errorf("follow symbolic link: %w", err)
+		}
+		if !fi.IsDir() {
+			return walkFile(p, fi.Mode().Type(), opts, fn)
+		}
+		if opts.skips(p, true) {
+			return nil
+		}
+		cycle, err := onWalkPath(dir, p, fi)
+		if err != nil {
+			return fmt.Errorf("follow symbolic link: %w", err)
+		}
+		if cycle {
+			log.Printf("skip: %s: symbolic link cycle", p)
+			return nil
+		}
+		return walkTree(dir, p, opts, fn, dirFn)
+	})
+}
+
+// onWalkPath reports whether the directory fi is one the walk is in at the
+// slash separated path p below dir: dir itself or a directory on the way to
+// p, reached through real directories and links alike. Comparing the files,
+// by their device and inode on Unix, also catches the cycles of links
+// between siblings, such as a/b -> ../b and b/a -> ../a.
+func onWalkPath(dir, p string, fi os.FileInfo) (bool, error) {
+	cur := dir
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		afi, err := os.Stat(cur)
+		if err != nil {
+			return false, err
+		}
+		if os.SameFile(fi, afi) {
+			return true, nil
+		}
+		cur = filepath.Join(cur, parts[i])
+	}
+	return false, nil
+}
+
+// walkDepth returns the depth of the slash separated path p below the
+// root of the walk, 1 for the entries of the root.
+func walkDepth(p string) int {
+	return strings.Count(p, "/") + 1
+}
+
+// walkFile calls fn with the file p of the type t if it is a regular file.
+func walkFile(p string, t fs.FileMode, opts walkOptions, fn func(p string) error) error {
+	if t.IsRegular() {
+		return fn(p)
+	}
+	if opts.Strict {
+		return fmt.Errorf("%s: not a regular file (%s)", p, fileTypeName(t))
+	}
+	log.Printf("skip: %s: not a regular file (%s)", p, fileTypeName(t))
+	return nil
+}
+
+// fileTypeName returns the name of the type of a non-regular file.
+func fileTypeName(t fs.FileMode) string {
+	switch {
+	case t&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case t&fs.ModeSocket != 0:
+		return "socket"
+	case t&fs.ModeCharDevice != 0:
+		return "character device"
+	case t&fs.ModeDevice != 0:
+		return "block device"
+	}
+	return "irregular"
+}
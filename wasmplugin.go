@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmPageSize is the size of a page of WebAssembly memory.
+const wasmPageSize = 64 * 1024
+
+var errPluginKilled = errors.New("plugin killed")
+
+// startWasmPlugin runs the WASI command module in the file name as a
+// -plugin-wasm, speaking the protocol of -plugin on its standard input and
+// output. The module is sandboxed: it sees no files, no environment and no
+// network, only the clocks. Its memory is limited to maxMemory bytes unless
+// 0, and it is stopped at the next function call or loop iteration when
+// killed.
+func startWasmPlugin(ctx context.Context, name string, timeout time.Duration, maxMemory uint64) (*plugin, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("plugin: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cfg := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if maxMemory > 0 {
+		cfg = cfg.WithMemoryLimitPages(uint32(min(maxMemory/wasmPageSize, 65536)))
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, cfg)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		cancel()
+		r.Close(context.Background())
+		return nil, fmt.Errorf("plugin: %w", err)
+	}
+	compiled, err := r.CompileModule(ctx, b)
+	if err != nil {
+		cancel()
+		r.Close(context.Background())
+		return nil, fmt.Errorf("plugin(%s): %w", name, err)
+	}
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	modCfg := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(name).
+		WithStdin(stdinR).
+		WithStdout(stdoutW).
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime()
+	done := make(chan error, 1)
+	go func() {
+		// running _start returns once the module exits, e.g. at the end of
+		// its input.
+		_, err := r.InstantiateModule(ctx, compiled, modCfg)
+		stdinR.CloseWithError(io.ErrClosedPipe)
+		stdoutW.Close()
+		r.Close(context.Background())
+		done <- err
+	}()
+	return &plugin{
+		timeout: timeout,
+		kill: func() {
+			cancel()
+			stdinR.CloseWithError(errPluginKilled)
+		},
+		wait: func() error {
+			err := <-done
+			if ctx.Err() != nil {
+				// killed by us.
+				return nil
+			}
+			cancel()
+			return err
+		},
+		stdin:  stdinW,
+		stdout: bufio.NewReader(stdoutR),
+	}, nil
+}
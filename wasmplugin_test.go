@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildWasmPlugin builds testdata/wasmplugin as a WASI module.
+func buildWasmPlugin(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a WebAssembly module")
+	}
+	out := filepath.Join(t.TempDir(), "plugin.wasm")
+	cmd := exec.Command("go", "build", "-o", out, "./testdata/wasmplugin")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("build wasm plugin: %v\n%s", err, b)
+	}
+	return out
+}
+
+func TestWasmPlugin(t *testing.T) {
+	wasm := buildWasmPlugin(t)
+	p, err := startWasmPlugin(context.Background(), wasm, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Ask(&pluginRequest{Source: "a/b.csv", Bucket: "b", Object: "p/a/b.csv", Size: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Object != "renamed/p/a/b.csv" || resp.Metadata["size"] != "42" || resp.Skip {
+		t.Errorf("Ask = %+v", resp)
+	}
+	if resp, err = p.Ask(&pluginRequest{Source: "x.tmp"}); err != nil || !resp.Skip {
+		t.Errorf("Ask(x.tmp) = %+v, %v, want skip", resp, err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
+
+func TestWasmPluginTimeout(t *testing.T) {
+	wasm := buildWasmPlugin(t)
+	p, err := startWasmPlugin(context.Background(), wasm, 500*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Ask(&pluginRequest{Source: "hang"}); err == nil || !strings.Contains(err.Error(), "no answer within") {
+		t.Errorf("Ask(hang) = %v, want a timeout", err)
+	}
+	// a killed plugin fails every later request.
+	if _, err := p.Ask(&pluginRequest{Source: "a"}); err == nil {
+		t.Error("Ask after the timeout = nil error")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
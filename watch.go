@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sync/errgroup"
+)
+
+type pendingFile struct {
+	lastEvent time.Time
+	size      int64
+	modTime   time.Time
+}
+
+// watcher uploads files created or modified below dir. Events are debounced
+// per file and a file is only uploaded once it has been left untouched for
+// the settle delay, so partially written files are not picked up.
+type watcher struct {
+	dir    string
+	settle time.Duration
+	upload func(ctx context.Context, rel string) error
+	// opts are those of the walk of dir, leaving out the same files.
+	opts walkOptions
+
+	w       *fsnotify.Watcher
+	pending map[string]*pendingFile
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func watchDir(ctx context.Context, dir string, opts walkOptions, settle time.Duration, n int, upload func(ctx context.Context, rel string) error) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("new watcher: %w", err)
+	}
+	defer fw.Close()
+
+	wt := &watcher{
+		dir:      dir,
+		settle:   settle,
+		upload:   upload,
+		opts:     opts,
+		w:        fw,
+		pending:  map[string]*pendingFile{},
+		inflight: map[string]bool{},
+	}
+	if err := wt.addTree(".", false); err != nil {
+		return err
+	}
+
+	var eg errgroup.Group
+	eg.SetLimit(n)
+	defer eg.Wait()
+
+	tick := time.NewTicker(max(settle/2, 100*time.Millisecond))
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("watch: %v", err)
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			wt.handle(ev)
+		case now := <-tick.C:
+			wt.flush(ctx, &eg, now)
+		}
+	}
+}
+
+// addTree watches the directory at the slash separated path root below dir
+// and every directory below it the walk descends into. Files found in a
+// newly created directory are queued as well, since they may have been
+// written before the watch was added.
+func (wt *watcher) addTree(root string, queue bool) error {
+	return walkTree(wt.dir, root, wt.opts, func(p string) error {
+		if queue {
+			wt.touch(wt.path(p))
+		}
+		return nil
+	}, func(p string) error {
+		if err := wt.w.Add(wt.path(p)); err != nil {
+			return fmt.Errorf("watch(%s): %w", p, err)
+		}
+		return nil
+	})
+}
+
+// path returns the path of the slash separated path p below dir.
+func (wt *watcher) path(p string) string {
+	return filepath.Join(wt.dir, filepath.FromSlash(p))
+}
+
+// stat returns the file info of p, of what it links to if the walk follows
+// symbolic links.
+func (wt *watcher) stat(p string) (os.FileInfo, error) {
+	if wt.opts.Symlinks == "follow" {
+		return os.Stat(p)
+	}
+	return os.Lstat(p)
+}
+
+func (wt *watcher) handle(ev fsnotify.Event) {
+	switch {
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		delete(wt.pending, ev.Name)
+	case ev.Has(fsnotify.Create), ev.Has(fsnotify.Write):
+		rel, err := filepath.Rel(wt.dir, ev.Name)
+		if err != nil {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		fi, err := os.Lstat(ev.Name)
+		if err != nil {
+			return
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			switch wt.opts.Symlinks {
+			case "skip":
+				return
+			case "error":
+				log.Printf("watch: %s: symbolic link", rel)
+				return
+			}
+			if fi, err = os.Stat(ev.Name); err != nil {
+				return
+			}
+		}
+		if wt.opts.skips(rel, fi.IsDir()) {
+			return
+		}
+		if fi.IsDir() {
+			if ev.Has(fsnotify.Create) {
+				if err := wt.addTree(rel, true); err != nil {
+					log.Printf("watch: %v", err)
+				}
+			}
+			return
+		}
+		wt.touch(ev.Name)
+	}
+}
+
+func (wt *watcher) touch(p string) {
+	fi, err := wt.stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	wt.pending[p] = &pendingFile{lastEvent: time.Now(), size: fi.Size(), modTime: fi.ModTime()}
+}
+
+func (wt *watcher) flush(ctx context.Context, eg *errgroup.Group, now time.Time) {
+	for p, pf := range wt.pending {
+		if now.Sub(pf.lastEvent) < wt.settle {
+			continue
+		}
+		fi, err := wt.stat(p)
+		if err != nil {
+			delete(wt.pending, p)
+			continue
+		}
+		// a writer that does not trigger events (e.g. mmap) still changes
+		// the size or mtime.
+		if fi.Size() != pf.size || !fi.ModTime().Equal(pf.modTime) {
+			pf.lastEvent, pf.size, pf.modTime = now, fi.Size(), fi.ModTime()
+			continue
+		}
+		rel, err := filepath.Rel(wt.dir, p)
+		if err != nil {
+			delete(wt.pending, p)
+			continue
+		}
+		wt.mu.Lock()
+		busy := wt.inflight[p]
+		wt.inflight[p] = true
+		wt.mu.Unlock()
+		if busy {
+			continue
+		}
+		started := eg.TryGo(func() error {
+			defer func() {
+				wt.mu.Lock()
+				delete(wt.inflight, p)
+				wt.mu.Unlock()
+			}()
+			if err := wt.upload(ctx, rel); err != nil {
+				log.Printf("watch: %s: %v", rel, err)
+			}
+			return nil
+		})
+		if !started {
+			wt.mu.Lock()
+			delete(wt.inflight, p)
+			wt.mu.Unlock()
+			continue
+		}
+		delete(wt.pending, p)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWatcherAddTreeFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"a/b/c", ".hidden", ".keep"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(p)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"f", ".f", "a/f", "a/b/f", ".hidden/f", ".keep/f"} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(p)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := compileGlob(".keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	wt := &watcher{
+		dir:     dir,
+		opts:    walkOptions{MaxDepth: 2, SkipHidden: true, IncludeHidden: globList{g}},
+		w:       fw,
+		pending: map[string]*pendingFile{},
+	}
+	if err := wt.addTree(".", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var watched, queued []string
+	for _, p := range fw.WatchList() {
+		rel, _ := filepath.Rel(dir, p)
+		watched = append(watched, filepath.ToSlash(rel))
+	}
+	for p := range wt.pending {
+		rel, _ := filepath.Rel(dir, p)
+		queued = append(queued, filepath.ToSlash(rel))
+	}
+	slices.Sort(watched)
+	slices.Sort(queued)
+	if want := []string{".", ".keep", "a"}; !slices.Equal(watched, want) {
+		t.Errorf("watched = %q, want %q", watched, want)
+	}
+	if want := []string{".keep/f", "a/f", "f"}; !slices.Equal(queued, want) {
+		t.Errorf("queued = %q, want %q", queued, want)
+	}
+}